@@ -0,0 +1,144 @@
+package spdy3
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+)
+
+// The most a single header block may decompress to, as with
+// http.DefaultMaxHeaderBytes.
+const MaxHeaderBlockSize = 1 << 20
+
+var ErrHeaderBlockTooLarge = errors.New("Header block too large")
+
+// ----------------------------------------------------------------------------
+// Header Compression
+//
+// The header block of SYN_STREAM, SYN_REPLY and HEADERS frames is compressed
+// with zlib. There is a single zlib stream (context) for all name value pairs in
+// one direction on a connection, and each header block is terminated with a
+// sync flush so that it can be decoded as soon as its frame arrives. Each
+// version of SPDY primes the stream with its own dictionary, and SPDY/2 uses
+// 16 bit lengths within the block.
+
+type headerCompressor struct {
+	version SpdyVersion
+	buf     *bytes.Buffer
+	w       *zlib.Writer
+}
+
+func newHeaderCompressor(version SpdyVersion) *headerCompressor {
+	buf := new(bytes.Buffer)
+	// NewWriterLevelDict only errs on an invalid level.
+	w, _ := zlib.NewWriterLevelDict(buf, zlib.BestCompression, headerDictionary(version))
+	return &headerCompressor{
+		version: version,
+		buf:     buf,
+		w:       w,
+	}
+}
+
+func (c *headerCompressor) Compress(nvp NameValuePairs) (CompressedNameValuePairs, error) {
+	if _, err := nvp.write(c.w, c.version); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	compressed := make(CompressedNameValuePairs, c.buf.Len())
+	copy(compressed, c.buf.Bytes())
+	c.buf.Reset()
+	return compressed, nil
+}
+
+type headerDecompressor struct {
+	version SpdyVersion
+	buf     *bytes.Buffer
+	r       io.ReadCloser
+}
+
+func newHeaderDecompressor(version SpdyVersion) *headerDecompressor {
+	return &headerDecompressor{
+		version: version,
+		buf:     new(bytes.Buffer),
+	}
+}
+
+func (d *headerDecompressor) Decompress(compressed CompressedNameValuePairs) (nvp NameValuePairs, err error) {
+	nvp = make(NameValuePairs)
+	if len(compressed) == 0 {
+		return
+	}
+
+	d.buf.Write(compressed)
+
+	// The zlib header is only present in the very first block of the stream,
+	// so the reader cannot be created until it has arrived.
+	if d.r == nil {
+		if d.r, err = zlib.NewReaderDict(d.buf, headerDictionary(d.version)); err != nil {
+			return nil, err
+		}
+	}
+
+	block := &headerBlockReader{r: d.r, left: MaxHeaderBlockSize}
+	if _, err = nvp.read(block, d.version); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return
+}
+
+// Discard decompresses a header block only to keep the compression context in
+// step with the peer's, for a frame which is not going to be read. The layout
+// of the block is not checked, so it may be one of another version.
+func (d *headerDecompressor) Discard(compressed CompressedNameValuePairs) (err error) {
+	if len(compressed) == 0 {
+		return
+	}
+
+	d.buf.Write(compressed)
+	if d.r == nil {
+		if d.r, err = zlib.NewReaderDict(d.buf, headerDictionary(d.version)); err != nil {
+			return
+		}
+	}
+
+	// A block ends in a sync flush, so once all of it has been taken from buf
+	// everything it decompresses to has been read
+	block := &headerBlockReader{r: d.r, left: MaxHeaderBlockSize}
+	p := make([]byte, 512)
+	for d.buf.Len() > 0 {
+		if _, err = block.Read(p); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+	}
+	return
+}
+
+// headerBlockReader reads a decompressed header block, failing once it has read
+// MaxHeaderBlockSize bytes. A block that large leaves the compression context
+// part way through it, so the session cannot carry on.
+type headerBlockReader struct {
+	r    io.Reader
+	left int
+}
+
+func (b *headerBlockReader) Read(p []byte) (int, error) {
+	if b.left <= 0 {
+		return 0, ErrHeaderBlockTooLarge
+	}
+	if len(p) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.r.Read(p)
+	b.left -= n
+	return n, err
+}
@@ -0,0 +1,106 @@
+package spdy3
+
+import (
+	"bytes"
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Header compression", func() {
+	var (
+		compressor   *headerCompressor
+		decompressor *headerDecompressor
+	)
+
+	BeforeEach(func() {
+		compressor = newHeaderCompressor(Spdy3)
+		decompressor = newHeaderDecompressor(Spdy3)
+	})
+
+	It("should round trip a header block", func() {
+		nvp := NameValuePairs{":method": {"GET"}, ":path": {"/"}}
+		compressed, err := compressor.Compress(nvp)
+		Expect(err).To(BeNil())
+		Expect(decompressor.Decompress(compressed)).To(Equal(nvp))
+	})
+
+	It("should share one context across blocks", func() {
+		first, err := compressor.Compress(NameValuePairs{"user-agent": {"spdy3"}})
+		Expect(err).To(BeNil())
+		second, err := compressor.Compress(NameValuePairs{"user-agent": {"spdy3"}})
+		Expect(err).To(BeNil())
+
+		// The second block should lean on the first
+		Expect(len(second)).To(BeNumerically("<", len(first)))
+
+		Expect(decompressor.Decompress(first)).To(Equal(
+			NameValuePairs{"user-agent": {"spdy3"}}))
+		Expect(decompressor.Decompress(second)).To(Equal(
+			NameValuePairs{"user-agent": {"spdy3"}}))
+	})
+
+	It("should not decode a block out of order", func() {
+		_, err := compressor.Compress(NameValuePairs{"a": {"b"}})
+		Expect(err).To(BeNil())
+		second, err := compressor.Compress(NameValuePairs{"c": {"d"}})
+		Expect(err).To(BeNil())
+
+		_, err = decompressor.Decompress(second)
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("should not decompress a block past the size limit", func() {
+		nvp := make(NameValuePairs)
+		value := string(bytes.Repeat([]byte("x"), 1<<10))
+		for i := 0; i < MaxHeaderBlockSize>>10; i++ {
+			nvp.Set(fmt.Sprintf("x-%d", i), value)
+		}
+		compressed, err := compressor.Compress(nvp)
+		Expect(err).To(BeNil())
+		Expect(len(compressed)).To(BeNumerically("<", MaxHeaderBlockSize/16))
+
+		_, err = decompressor.Decompress(compressed)
+		Expect(err).To(Equal(ErrHeaderBlockTooLarge))
+	})
+
+	It("should not make room for a value past the size limit", func() {
+		nvp := NameValuePairs{"x": {string(bytes.Repeat([]byte("x"), MaxHeaderBlockSize))}}
+		compressed, err := compressor.Compress(nvp)
+		Expect(err).To(BeNil())
+
+		_, err = decompressor.Decompress(compressed)
+		Expect(err).To(Equal(ErrHeaderBlockTooLarge))
+	})
+
+	It("should read frames compressed by another implementation", func() {
+		framer := NewFramer(Spdy3, bytes.NewBuffer([]byte{
+			0x80, 0x03, 0x00, 0x01, 0x01, 0x00, 0x00, 0x33,
+			0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+			0x40, 0x00, 0x78, 0xF9, 0xE3, 0xC6, 0xA7, 0xC2,
+			0x62, 0x60, 0x60, 0x60, 0x62, 0x60, 0x60, 0x60,
+			0xB7, 0x42, 0xA4, 0x5A, 0x77, 0xD7, 0x10, 0x06,
+			0x06, 0x06, 0x56, 0xAB, 0x82, 0xC4, 0x92, 0x0C,
+			0x06, 0x06, 0x06, 0x46, 0x7D, 0x00, 0x00, 0x00,
+			0x00, 0xFF, 0xFF, 0x80, 0x03, 0x00, 0x02, 0x00,
+			0x00, 0x00, 0x13, 0x00, 0x00, 0x00, 0x01, 0x62,
+			0x60, 0x60, 0x60, 0x04, 0xAB, 0x41, 0x4F, 0xC8,
+			0x00, 0x00, 0x00, 0x00, 0xFF, 0xFF,
+		}))
+
+		frame, err := framer.Read()
+		Expect(err).To(BeNil())
+		synStream := frame.(*SynStream)
+		Expect(synStream.Flags).To(Equal(FlagFin))
+		Expect(synStream.StreamId).To(Equal(uint32(1)))
+		Expect(synStream.Priority).To(Equal(uint8(2)))
+		Expect(synStream.Headers).To(Equal(
+			NameValuePairs{":method": {"GET"}, ":path": {"/"}}))
+
+		frame, err = framer.Read()
+		Expect(err).To(BeNil())
+		Expect(frame.(*SynReply).Headers).To(Equal(
+			NameValuePairs{":status": {"200 OK"}}))
+	})
+})
@@ -0,0 +1,238 @@
+package spdy3
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrNoCredentials = errors.New("Credentials need a SPDY/3 session over TLS")
+	ErrBadSlot       = errors.New("Slot is outside the server's certificate vector")
+)
+
+const (
+	// The size of a server's client certificate vector until it says
+	// otherwise.
+	defaultCredentialVectorSize = 8
+
+	// The label the keying material a proof signs is exported with.
+	credentialProofLabel = "EXPORTER SPDY certificate proof"
+)
+
+// ----------------------------------------------------------------------------
+// Credentials
+//
+// A client which wants to send requests for more than one origin over a
+// session can authenticate each of them with a different client certificate.
+// It sends the certificate chain in a CREDENTIAL frame, which the server keeps
+// in a slot of its certificate vector, along with a proof that the client holds
+// the chain's private key. Each SYN_STREAM then names the slot its request is
+// sent with.
+//
+// The proof is a signature over 32 bytes of keying material exported from the
+// TLS connection, with the origin of the requests as context. As the frame does
+// not carry the origin, the server checks the proof once a stream names the
+// slot, against the origin of that stream.
+type credential struct {
+	chain []*x509.Certificate
+	proof []byte
+
+	// Origins the proof has been checked against.
+	mu       sync.Mutex
+	verified map[string]bool
+}
+
+// SendCredential stores the certificate chain of cert in slot, counting from 1,
+// of the server's certificate vector, proving that we hold its private key for
+// origin, such as "https://example.com". The origin is serialized as the server
+// will see it, lower case and without a default port. Streams then opened with
+// OpenStreamWithCredential naming the slot are sent with that certificate.
+func (s *Session) SendCredential(slot uint8, origin string, cert tls.Certificate) error {
+	conn, ok := s.conn.(*tls.Conn)
+	if !ok || s.framer.Version != Spdy3 || s.server {
+		return ErrNoCredentials
+	}
+	s.mu.Lock()
+	size := s.peerVectorSize
+	s.mu.Unlock()
+	if slot == 0 || int(slot) > size {
+		return ErrBadSlot
+	}
+
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("spdy3: cannot sign with a %T", cert.PrivateKey)
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("spdy3: bad credential origin %q", origin)
+	}
+	secret, err := proofSecret(conn, credentialOrigin(u.Scheme, u.Host))
+	if err != nil {
+		return err
+	}
+	proof, err := signProof(signer, secret)
+	if err != nil {
+		return err
+	}
+
+	return s.writeFrame(&Credential{
+		Slot:         uint16(slot),
+		Proof:        proof,
+		Certificates: cert.Certificate,
+	})
+}
+
+// OpenStreamWithCredential opens a stream like OpenStreamWithPriority, sent
+// with the client certificate in slot. The server resets it with
+// INVALID_CREDENTIALS if the slot is empty, or its proof does not hold for the
+// stream's origin.
+func (s *Session) OpenStreamWithCredential(headers NameValuePairs, priority, slot uint8) (*Stream, error) {
+	if priority > lowestPriority {
+		return nil, ErrBadPriority
+	}
+	return s.openStream(headers, priority, slot, 0, nil)
+}
+
+// handleCredential stores a client certificate chain in the server's vector. A
+// malformed CREDENTIAL frame ends the session.
+func (s *Session) handleCredential(frame *Credential) error {
+	if !s.server {
+		return sessionError(GoAwayProtocolError, "server sent a CREDENTIAL frame")
+	}
+	if frame.Slot == 0 || int(frame.Slot) > len(s.credentials) {
+		return sessionError(GoAwayProtocolError,
+			"CREDENTIAL for slot %d of %d", frame.Slot, len(s.credentials))
+	}
+	if len(frame.Certificates) == 0 {
+		return sessionError(GoAwayProtocolError, "CREDENTIAL with no certificates")
+	}
+
+	chain := make([]*x509.Certificate, len(frame.Certificates))
+	for i, der := range frame.Certificates {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return sessionError(GoAwayProtocolError, "bad CREDENTIAL certificate: %s", err)
+		}
+		chain[i] = cert
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.credentials[frame.Slot-1] = &credential{
+		chain:    chain,
+		proof:    frame.Proof,
+		verified: make(map[string]bool),
+	}
+	return nil
+}
+
+// checkCredential finds the certificate chain in the slot a stream names, and
+// checks its proof holds for the stream's origin.
+func (s *Session) checkCredential(frame *SynStream) ([]*x509.Certificate, *StreamError) {
+	fail := func(reason string) ([]*x509.Certificate, *StreamError) {
+		return nil, &StreamError{
+			StreamId:   frame.StreamId,
+			StatusCode: InvalidCredentials,
+			Reason:     reason,
+		}
+	}
+
+	conn, ok := s.conn.(*tls.Conn)
+	if !ok || !s.server {
+		return fail("credentials need a server session over TLS")
+	}
+
+	var cred *credential
+	s.mu.Lock()
+	if int(frame.Slot) <= len(s.credentials) {
+		cred = s.credentials[frame.Slot-1]
+	}
+	s.mu.Unlock()
+	if cred == nil {
+		return fail(fmt.Sprintf("no credential in slot %d", frame.Slot))
+	}
+
+	scheme, host := frame.Headers.Get(":scheme"), frame.Headers.Get(":host")
+	if scheme == "" || host == "" {
+		return fail("no origin to check the credential against")
+	}
+	origin := credentialOrigin(scheme, host)
+
+	cred.mu.Lock()
+	defer cred.mu.Unlock()
+	if cred.verified[origin] {
+		return cred.chain, nil
+	}
+	secret, err := proofSecret(conn, origin)
+	if err != nil {
+		return fail(err.Error())
+	}
+	if err := verifyProof(cred.chain[0].PublicKey, secret, cred.proof); err != nil {
+		return fail(fmt.Sprintf("bad proof for %s: %s", origin, err))
+	}
+	cred.verified[origin] = true
+	return cred.chain, nil
+}
+
+// credentialOrigin serializes an origin as RFC 6454 does, leaving out the
+// scheme's default port.
+func credentialOrigin(scheme, host string) string {
+	scheme, host = strings.ToLower(scheme), strings.ToLower(host)
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if (scheme == "https" && port == "443") || (scheme == "http" && port == "80") {
+			host = h
+			if strings.Contains(host, ":") {
+				host = "[" + host + "]"
+			}
+		}
+	}
+	return scheme + "://" + host
+}
+
+// proofSecret exports the keying material a proof for origin signs.
+func proofSecret(conn *tls.Conn, origin string) ([]byte, error) {
+	state := conn.ConnectionState()
+	return state.ExportKeyingMaterial(credentialProofLabel, []byte(origin), 32)
+}
+
+// signProof signs a SHA-256 digest of secret, or secret itself with an Ed25519
+// key.
+func signProof(signer crypto.Signer, secret []byte) ([]byte, error) {
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		return signer.Sign(rand.Reader, secret, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(secret)
+	return signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+func verifyProof(key crypto.PublicKey, secret, proof []byte) error {
+	digest := sha256.Sum256(secret)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], proof)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest[:], proof) {
+			return errors.New("ECDSA verification failure")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, secret, proof) {
+			return errors.New("Ed25519 verification failure")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T", key)
+}
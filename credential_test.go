@@ -0,0 +1,197 @@
+package spdy3
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Credentials", func() {
+	var (
+		clientCert tls.Certificate
+		listener   net.Listener
+		addr       string
+		client     *Session
+		servers    chan *Session
+	)
+
+	request := func() NameValuePairs {
+		return NameValuePairs{
+			":method":  {"GET"},
+			":path":    {"/"},
+			":version": {"HTTP/1.1"},
+			":scheme":  {"https"},
+			":host":    {addr},
+		}
+	}
+
+	// resetWith waits on the reply to a stream, which should be reset.
+	resetWith := func(stream *Stream) RstStreamStatus {
+		_, err := stream.ReplyHeaders()
+		var streamErr *StreamError
+		Expect(errors.As(err, &streamErr)).To(BeTrue())
+		return streamErr.StatusCode
+	}
+
+	BeforeEach(func() {
+		serverCert, pool := selfSigned()
+		clientCert, _ = selfSigned()
+		servers = make(chan *Session, 1)
+
+		var err error
+		listener, err = ListenTLS("tcp", "127.0.0.1:0", &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+		})
+		Expect(err).To(BeNil())
+		addr = listener.Addr().String()
+
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			config := &Config{Version: Spdy3, CredentialVectorSize: 4}
+			servers <- NewSession(conn, true, config)
+		}()
+
+		conn, err := tls.Dial("tcp", addr, &tls.Config{
+			RootCAs:    pool,
+			NextProtos: []string{NextProtoSpdy3},
+		})
+		Expect(err).To(BeNil())
+		client = NewSession(conn, false, nil)
+	})
+
+	AfterEach(func() {
+		client.Close()
+		listener.Close()
+		select {
+		case server := <-servers:
+			server.Close()
+		default:
+		}
+	})
+
+	It("should learn the size of the server's vector", func() {
+		Eventually(func() int {
+			client.mu.Lock()
+			defer client.mu.Unlock()
+			return client.peerVectorSize
+		}).Should(Equal(4))
+		Expect(client.SendCredential(5, "https://"+addr, clientCert)).To(Equal(ErrBadSlot))
+		Expect(client.SendCredential(0, "https://"+addr, clientCert)).To(Equal(ErrBadSlot))
+	})
+
+	It("should give streams the certificate in their slot", func() {
+		Expect(client.SendCredential(1, "https://"+addr, clientCert)).To(Succeed())
+		_, err := client.OpenStreamWithCredential(request(), 0, 1)
+		Expect(err).To(BeNil())
+
+		var server *Session
+		Eventually(servers).Should(Receive(&server))
+		servers <- server
+		stream, err := server.AcceptStream()
+		Expect(err).To(BeNil())
+		Expect(stream.Credential()).To(HaveLen(1))
+		Expect(stream.Credential()[0].Raw).To(Equal(clientCert.Certificate[0]))
+	})
+
+	It("should keep unverified certificates out of the request's TLS state", func() {
+		peers := make(chan int, 1)
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			peers <- len(r.TLS.PeerCertificates)
+		}
+		var server *Session
+		Eventually(servers).Should(Receive(&server))
+		servers <- server
+		go (&Server{Handler: http.HandlerFunc(handler)}).serveSession(server)
+
+		Expect(client.SendCredential(1, "https://"+addr, clientCert)).To(Succeed())
+		stream, err := client.OpenStreamWithCredential(request(), 0, 1)
+		Expect(err).To(BeNil())
+		Expect(stream.CloseWrite()).To(Succeed())
+		Eventually(peers).Should(Receive(Equal(0)))
+	})
+
+	It("should accept a proof for the origin written another way", func() {
+		host, port, _ := net.SplitHostPort(addr)
+		Expect(client.SendCredential(1, "HTTPS://"+net.JoinHostPort(host, port), clientCert)).To(Succeed())
+		_, err := client.OpenStreamWithCredential(request(), 0, 1)
+		Expect(err).To(BeNil())
+
+		var server *Session
+		Eventually(servers).Should(Receive(&server))
+		servers <- server
+		stream, err := server.AcceptStream()
+		Expect(err).To(BeNil())
+		Expect(stream.Credential()).To(HaveLen(1))
+	})
+
+	It("should not sign a proof for a malformed origin", func() {
+		Expect(client.SendCredential(1, "example.com", clientCert)).NotTo(Succeed())
+	})
+
+	It("should not give streams without a slot a certificate", func() {
+		Expect(client.SendCredential(1, "https://"+addr, clientCert)).To(Succeed())
+		_, err := client.OpenStream(request())
+		Expect(err).To(BeNil())
+
+		var server *Session
+		Eventually(servers).Should(Receive(&server))
+		servers <- server
+		stream, err := server.AcceptStream()
+		Expect(err).To(BeNil())
+		Expect(stream.Credential()).To(BeNil())
+	})
+
+	It("should reset streams naming an empty slot", func() {
+		stream, err := client.OpenStreamWithCredential(request(), 0, 2)
+		Expect(err).To(BeNil())
+		Expect(resetWith(stream)).To(Equal(InvalidCredentials))
+	})
+
+	It("should reset streams whose proof is for another origin", func() {
+		Expect(client.SendCredential(1, "https://example.com", clientCert)).To(Succeed())
+		stream, err := client.OpenStreamWithCredential(request(), 0, 1)
+		Expect(err).To(BeNil())
+		Expect(resetWith(stream)).To(Equal(InvalidCredentials))
+	})
+
+	It("should reset streams whose proof is not signed by the certificate", func() {
+		other, _ := selfSigned()
+		forged := tls.Certificate{
+			Certificate: clientCert.Certificate,
+			PrivateKey:  other.PrivateKey,
+		}
+		Expect(client.SendCredential(1, "https://"+addr, forged)).To(Succeed())
+		stream, err := client.OpenStreamWithCredential(request(), 0, 1)
+		Expect(err).To(BeNil())
+		Expect(resetWith(stream)).To(Equal(InvalidCredentials))
+	})
+
+	It("should end the session over a CREDENTIAL with no certificates", func() {
+		Expect(client.writeFrame(&Credential{Slot: 1})).To(Succeed())
+		Eventually(client.Closed()).Should(BeClosed())
+	})
+
+	It("should only send credentials over TLS", func() {
+		conn, _ := net.Pipe()
+		defer conn.Close()
+		session := NewSession(conn, false, nil)
+		defer session.Close()
+		Expect(session.SendCredential(1, "https://"+addr, clientCert)).To(Equal(ErrNoCredentials))
+	})
+})
+
+var _ = Describe("Credential origins", func() {
+	It("should leave out default ports", func() {
+		Expect(credentialOrigin("https", "example.com:443")).To(Equal("https://example.com"))
+		Expect(credentialOrigin("http", "example.com:80")).To(Equal("http://example.com"))
+		Expect(credentialOrigin("HTTPS", "Example.com:8443")).To(Equal("https://example.com:8443"))
+		Expect(credentialOrigin("https", "[::1]:443")).To(Equal("https://[::1]"))
+	})
+})
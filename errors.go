@@ -0,0 +1,179 @@
+package spdy3
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ----------------------------------------------------------------------------
+// RST_STREAM Status Codes
+//
+// The status code of a RST_STREAM frame indicates why the stream is being
+// terminated.
+type RstStreamStatus int32
+
+const (
+	ProtocolError       RstStreamStatus = 1
+	InvalidStream       RstStreamStatus = 2
+	RefusedStream       RstStreamStatus = 3
+	UnsupportedVersion  RstStreamStatus = 4
+	Cancel              RstStreamStatus = 5
+	InternalError       RstStreamStatus = 6
+	FlowControlError    RstStreamStatus = 7
+	StreamInUse         RstStreamStatus = 8
+	StreamAlreadyClosed RstStreamStatus = 9
+	InvalidCredentials  RstStreamStatus = 10
+	FrameTooLarge       RstStreamStatus = 11
+)
+
+var rstStreamStatusNames = map[RstStreamStatus]string{
+	ProtocolError:       "PROTOCOL_ERROR",
+	InvalidStream:       "INVALID_STREAM",
+	RefusedStream:       "REFUSED_STREAM",
+	UnsupportedVersion:  "UNSUPPORTED_VERSION",
+	Cancel:              "CANCEL",
+	InternalError:       "INTERNAL_ERROR",
+	FlowControlError:    "FLOW_CONTROL_ERROR",
+	StreamInUse:         "STREAM_IN_USE",
+	StreamAlreadyClosed: "STREAM_ALREADY_CLOSED",
+	InvalidCredentials:  "INVALID_CREDENTIALS",
+	FrameTooLarge:       "FRAME_TOO_LARGE",
+}
+
+func (s RstStreamStatus) String() string {
+	if name, ok := rstStreamStatusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("RST_STREAM status %d", int32(s))
+}
+
+// ----------------------------------------------------------------------------
+// GOAWAY Status Codes
+//
+// The status code of a GOAWAY frame indicates why the session is being closed.
+type GoAwayStatus uint32
+
+const (
+	GoAwayOK            GoAwayStatus = 0
+	GoAwayProtocolError GoAwayStatus = 1
+	GoAwayInternalError GoAwayStatus = 2
+)
+
+var goAwayStatusNames = map[GoAwayStatus]string{
+	GoAwayOK:            "OK",
+	GoAwayProtocolError: "PROTOCOL_ERROR",
+	GoAwayInternalError: "INTERNAL_ERROR",
+}
+
+func (s GoAwayStatus) String() string {
+	if name, ok := goAwayStatusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("GOAWAY status %d", uint32(s))
+}
+
+// ----------------------------------------------------------------------------
+// Errors
+
+// A StreamError is an error which only affects a single stream. The session can
+// carry on after answering it with a RST_STREAM frame holding its status code.
+type StreamError struct {
+	StreamId   uint32
+	StatusCode RstStreamStatus
+	Reason     string
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("spdy3: stream %d: %s: %s",
+		e.StreamId, e.StatusCode, e.Reason)
+}
+
+// Frame returns the RST_STREAM frame which reports this error to the peer.
+func (e *StreamError) Frame() *RstStream {
+	return &RstStream{
+		StreamId:   e.StreamId,
+		StatusCode: e.StatusCode,
+	}
+}
+
+// A SessionError is an error after which the session can no longer continue.
+// It is reported to the peer with a GOAWAY frame before the connection is
+// closed.
+type SessionError struct {
+	LastGoodStreamId uint32
+	StatusCode       GoAwayStatus
+	Reason           string
+}
+
+func (e *SessionError) Error() string {
+	return fmt.Sprintf("spdy3: session: %s: %s", e.StatusCode, e.Reason)
+}
+
+// Frame returns the GOAWAY frame which reports this error to the peer.
+func (e *SessionError) Frame() *GoAway {
+	return &GoAway{
+		LastGoodStreamId: e.LastGoodStreamId,
+		StatusCode:       e.StatusCode,
+	}
+}
+
+// A VersionError is returned for a control frame carrying a different version
+// of SPDY to the one the Framer speaks. Its body is skipped rather than read
+// with the wrong layout. A SYN_STREAM only fails its own stream, which is reset
+// with UNSUPPORTED_VERSION, and errors.As finds a *StreamError for it. Any
+// other frame leaves the session unable to carry on, and errors.As finds a
+// *SessionError.
+type VersionError struct {
+	Version  SpdyVersion
+	Expected SpdyVersion
+	Type     FrameType
+	StreamId uint32
+
+	err error
+}
+
+func newVersionError(header HeaderWord, expected SpdyVersion, body []byte) *VersionError {
+	e := &VersionError{
+		Version:  header.Version(),
+		Expected: expected.wire(),
+		Type:     header.Type(),
+	}
+	reason := fmt.Sprintf("version %d frame of type %d", e.Version, e.Type)
+
+	// Every version of SYN_STREAM leads with the stream id
+	if e.Type == SynStreamType && len(body) >= 4 {
+		e.StreamId = binary.BigEndian.Uint32(body) & 0x7FFFFFFF
+		e.err = &StreamError{
+			StreamId:   e.StreamId,
+			StatusCode: UnsupportedVersion,
+			Reason:     reason,
+		}
+	} else {
+		e.err = sessionError(GoAwayProtocolError, "%s", reason)
+	}
+	return e
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("spdy3: expected SPDY version %d, got %d in a frame of type %d",
+		e.Expected, e.Version, e.Type)
+}
+
+// Unwrap returns the *StreamError or *SessionError the frame amounts to.
+func (e *VersionError) Unwrap() error {
+	return e.err
+}
+
+func protocolError(format string, args ...interface{}) *StreamError {
+	return &StreamError{
+		StatusCode: ProtocolError,
+		Reason:     fmt.Sprintf(format, args...),
+	}
+}
+
+func sessionError(status GoAwayStatus, format string, args ...interface{}) *SessionError {
+	return &SessionError{
+		StatusCode: status,
+		Reason:     fmt.Sprintf(format, args...),
+	}
+}
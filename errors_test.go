@@ -0,0 +1,73 @@
+package spdy3
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Status codes", func() {
+	It("should match the spec's RST_STREAM values", func() {
+		Expect(ProtocolError).To(Equal(RstStreamStatus(1)))
+		Expect(UnsupportedVersion).To(Equal(RstStreamStatus(4)))
+		Expect(FlowControlError).To(Equal(RstStreamStatus(7)))
+		Expect(FrameTooLarge).To(Equal(RstStreamStatus(11)))
+	})
+
+	It("should name themselves", func() {
+		Expect(RefusedStream.String()).To(Equal("REFUSED_STREAM"))
+		Expect(RstStreamStatus(99).String()).To(Equal("RST_STREAM status 99"))
+		Expect(GoAwayInternalError.String()).To(Equal("INTERNAL_ERROR"))
+	})
+})
+
+var _ = Describe("Errors", func() {
+	It("should be found with errors.As", func() {
+		err := fmt.Errorf("wrapped: %w", &StreamError{
+			StreamId:   3,
+			StatusCode: Cancel,
+		})
+
+		var streamErr *StreamError
+		Expect(errors.As(err, &streamErr)).To(BeTrue())
+		Expect(streamErr.StreamId).To(Equal(uint32(3)))
+		Expect(streamErr.StatusCode).To(Equal(Cancel))
+
+		var sessionErr *SessionError
+		Expect(errors.As(err, &sessionErr)).To(BeFalse())
+	})
+
+	It("should write a RST_STREAM for a stream error", func() {
+		buf := new(bytes.Buffer)
+		framer := NewFramer(Spdy3, buf)
+		err := &StreamError{StreamId: 5, StatusCode: RefusedStream}
+		Expect(framer.WriteError(err)).To(Succeed())
+		Expect(framer.Read()).To(Equal(&RstStream{
+			StreamId:   5,
+			StatusCode: RefusedStream,
+		}))
+	})
+
+	It("should write a GOAWAY for a session error", func() {
+		buf := new(bytes.Buffer)
+		framer := NewFramer(Spdy3, buf)
+		err := &SessionError{LastGoodStreamId: 7, StatusCode: GoAwayProtocolError}
+		Expect(framer.WriteError(err)).To(Succeed())
+		Expect(framer.Read()).To(Equal(&GoAway{
+			LastGoodStreamId: 7,
+			StatusCode:       GoAwayProtocolError,
+		}))
+	})
+
+	It("should write an INTERNAL_ERROR GOAWAY for anything else", func() {
+		buf := new(bytes.Buffer)
+		framer := NewFramer(Spdy3, buf)
+		Expect(framer.WriteError(errors.New("boom"))).To(Succeed())
+		Expect(framer.Read()).To(Equal(&GoAway{
+			StatusCode: GoAwayInternalError,
+		}))
+	})
+})
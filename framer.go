@@ -1,48 +1,314 @@
 package spdy3
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 )
 
 type Framer struct {
-	Version SpdyVersion
-	rw      io.ReadWriter
+	Version      SpdyVersion
+	rw           io.ReadWriter
+	compressor   *headerCompressor
+	decompressor *headerDecompressor
+}
+
+// The largest body a frame can carry in its 24 bit length.
+const MaxFrameLength = 0x00FFFFFF
+
+var ErrFrameTooLarge = errors.New("Frame too large")
+
+// controlFrame is a frame which knows how to encode and decode its own body.
+type controlFrame interface {
+	Frame
+	Read(r io.Reader) (int, error)
+	Write(w io.Writer) (int, error)
+	flags() uint8
 }
 
 func NewFramer(version SpdyVersion, rw io.ReadWriter) *Framer {
 	return &Framer{
-		Version: version,
-		rw:      rw,
+		Version:      version,
+		rw:           rw,
+		compressor:   newHeaderCompressor(version.wire()),
+		decompressor: newHeaderDecompressor(version.wire()),
 	}
 }
 
+// Read reads the next frame, skipping any control frames which are to be
+// ignored.
 func (f *Framer) Read() (fr Frame, err error) {
-	var header = new(HeaderWord)
-	if err = binary.Read(f.rw, binary.BigEndian, header); err != nil {
-		return
+	for {
+		var header = new(HeaderWord)
+		if err = binary.Read(f.rw, binary.BigEndian, header); err != nil {
+			return
+		}
+
+		if !header.Control() {
+			return f.readDataFrame(StreamIdWord(*header))
+		}
+		if fr, err = f.readControlFrame(*header); fr != nil || err != nil {
+			return
+		}
 	}
+}
 
-	if header.Control() {
-		return f.readControlFrame()
+func (f *Framer) readDataFrame(streamId StreamIdWord) (fr Frame, err error) {
+	flagLen := new(FlagLenWord)
+	if err = binary.Read(f.rw, binary.BigEndian, flagLen); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
 	}
 
-	return nil, errors.New("Can only read ctrl frames")
+	frame := &DataFrame{
+		Flags:    flagLen.Flags(),
+		StreamId: streamId.StreamId(),
+		Data:     make([]byte, flagLen.Length()),
+	}
+	if _, err = io.ReadFull(f.rw, frame.Data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	return frame, nil
 }
 
-func (f *Framer) readControlFrame() (fr Frame, err error) {
+// readControlFrame reads the body of a control frame. A frame which is to be
+// ignored yields neither a frame nor an error.
+func (f *Framer) readControlFrame(header HeaderWord) (fr Frame, err error) {
 	flagLen := new(FlagLenWord)
 	if err = binary.Read(f.rw, binary.BigEndian, flagLen); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return
 	}
 	bs := make([]byte, flagLen.Length())
 	if _, err = io.ReadFull(f.rw, bs); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	if header.Version() != f.Version.wire() {
+		return nil, f.versionError(header, bs)
+	}
+
+	var frame controlFrame
+	flags := flagLen.Flags()
+
+	switch header.Type() {
+	case SynStreamType:
+		frame = &SynStream{Flags: flags}
+	case SynReplyType:
+		frame = &SynReply{Flags: flags}
+	case RstStreamType:
+		frame = &RstStream{Flags: flags}
+	case SettingsType:
+		frame = &Settings{Flags: flags}
+	case NoopType:
+		if f.Version != Spdy2 {
+			return nil, nil
+		}
+		frame = &Noop{Flags: flags}
+	case PingType:
+		frame = &Ping{Flags: flags}
+	case GoAwayType:
+		frame = &GoAway{Flags: flags}
+	case HeadersType:
+		frame = &Headers{Flags: flags}
+	case WindowUpdateType:
+		frame = &WindowUpdate{Flags: flags}
+	case CredentialType:
+		if f.Version != Spdy3 {
+			return nil, nil
+		}
+		frame = &Credential{Flags: flags}
+	default:
+		// If an endpoint receives a control frame for a type it does not
+		// recognize, it MUST ignore the frame.
+		return nil, nil
+	}
+
+	if v2, ok := frame.(spdy2Frame); ok && f.Version == Spdy2 {
+		_, err = v2.readV2(bytes.NewReader(bs))
+	} else {
+		_, err = frame.Read(bytes.NewReader(bs))
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return
 	}
-	return nil, nil
+
+	if hf, ok := frame.(headerFrame); ok {
+		headers, compressed := hf.headerBlock()
+		if *headers, err = f.decompressor.Decompress(*compressed); err != nil {
+			if streamErr, ok := err.(*StreamError); ok {
+				streamErr.StreamId = hf.streamId()
+				return nil, err
+			}
+			// Anything else leaves the compression context unusable
+			return nil, sessionError(GoAwayProtocolError,
+				"bad header block on stream %d: %s", hf.streamId(), err)
+		}
+		if f.Version == Spdy2 {
+			*headers = fromSpdy2Headers(*headers)
+		}
+	}
+	return frame, nil
+}
+
+// versionError reports a frame of another version. A SYN_STREAM only costs the
+// peer its stream, so its header block still has to go through the compression
+// context. If it will not, the context is lost along with the session.
+func (f *Framer) versionError(header HeaderWord, body []byte) error {
+	err := newVersionError(header, f.Version, body)
+	offset := binary.Size(synStreamFramev3{})
+	if err.Type != SynStreamType || len(body) <= offset {
+		return err
+	}
+	if blockErr := f.decompressor.Discard(body[offset:]); blockErr != nil {
+		return sessionError(GoAwayProtocolError,
+			"bad header block on stream %d: %s", err.StreamId, blockErr)
+	}
+	return err
 }
 
+// Write serializes a frame and writes it to the underlying writer in a single
+// call.
 func (f *Framer) Write(fr Frame) (err error) {
-	return nil
+	if data, ok := fr.(*DataFrame); ok {
+		return f.writeDataFrame(data)
+	}
+
+	frame, ok := fr.(controlFrame)
+	if !ok {
+		return fmt.Errorf("Cannot write frame of type %T", fr)
+	}
+	if f.Version != Spdy3 && frame.Type() == CredentialType {
+		return errors.New("Only SPDY/3 has CREDENTIAL frames")
+	}
+	if f.Version != Spdy2 && frame.Type() == NoopType {
+		return errors.New("Only SPDY/2 has NOOP frames")
+	}
+
+	if hf, ok := frame.(headerFrame); ok {
+		headers, compressed := hf.headerBlock()
+		nvp := *headers
+		if f.Version == Spdy2 {
+			nvp = toSpdy2Headers(nvp)
+		}
+		if *compressed, err = f.compressor.Compress(nvp); err != nil {
+			if streamErr, ok := err.(*StreamError); ok {
+				streamErr.StreamId = hf.streamId()
+			}
+			return
+		}
+	}
+
+	body := new(bytes.Buffer)
+	if v2, ok := frame.(spdy2Frame); ok && f.Version == Spdy2 {
+		_, err = v2.writeV2(body)
+	} else {
+		_, err = frame.Write(body)
+	}
+	if err != nil {
+		return
+	}
+	if body.Len() > MaxFrameLength {
+		return ErrFrameTooLarge
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 8+body.Len()))
+	NewHeaderWord(true, f.Version, frame.Type()).Write(buf)
+	NewFlagLenWord(frame.flags(), uint32(body.Len())).Write(buf)
+	body.WriteTo(buf)
+
+	_, err = f.rw.Write(buf.Bytes())
+	return
+}
+
+// WriteError reports an error to the peer. A *StreamError is sent as a
+// RST_STREAM, a *SessionError as a GOAWAY. Any other error is treated as an
+// INTERNAL_ERROR for the whole session.
+func (f *Framer) WriteError(err error) error {
+	var streamErr *StreamError
+	if errors.As(err, &streamErr) {
+		return f.Write(streamErr.Frame())
+	}
+
+	var sessionErr *SessionError
+	if errors.As(err, &sessionErr) {
+		return f.Write(sessionErr.Frame())
+	}
+
+	return f.Write(&GoAway{StatusCode: GoAwayInternalError})
+}
+
+func (f *Framer) writeDataFrame(data *DataFrame) (err error) {
+	if len(data.Data) > MaxFrameLength {
+		return ErrFrameTooLarge
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 8+len(data.Data)))
+	StreamIdWord(data.StreamId & 0x7FFFFFFF).Write(buf)
+	NewFlagLenWord(data.Flags, uint32(len(data.Data))).Write(buf)
+	buf.Write(data.Data)
+
+	_, err = f.rw.Write(buf.Bytes())
+	return
+}
+
+// ----------------------------------------------------------------------------
+// SPDY/2 Header Names
+//
+// SPDY/2 has no ":" prefix on the headers which carry the request and status
+// lines, and calls the path "url". The Framer renames them as they go over the
+// wire, so everything above it sees the SPDY/3 names whichever version is
+// spoken.
+var spdy2HeaderNames = map[string]string{
+	":method":  "method",
+	":path":    "url",
+	":version": "version",
+	":host":    "host",
+	":scheme":  "scheme",
+	":status":  "status",
+}
+
+var spdy3HeaderNames = map[string]string{
+	"method":  ":method",
+	"url":     ":path",
+	"version": ":version",
+	"host":    ":host",
+	"scheme":  ":scheme",
+	"status":  ":status",
+}
+
+// toSpdy2Headers returns a copy of nvp with its headers renamed for SPDY/2.
+func toSpdy2Headers(nvp NameValuePairs) NameValuePairs {
+	return renameHeaders(nvp, spdy2HeaderNames)
+}
+
+// fromSpdy2Headers returns the headers of a SPDY/2 block under their SPDY/3
+// names.
+func fromSpdy2Headers(nvp NameValuePairs) NameValuePairs {
+	return renameHeaders(nvp, spdy3HeaderNames)
+}
+
+func renameHeaders(nvp NameValuePairs, names map[string]string) NameValuePairs {
+	renamed := make(NameValuePairs, len(nvp))
+	for name, values := range nvp {
+		if to, ok := names[name]; ok {
+			name = to
+		}
+		renamed[name] = values
+	}
+	return renamed
 }
@@ -2,6 +2,10 @@ package spdy3
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/adler32"
 	"io"
 
 	. "github.com/onsi/ginkgo"
@@ -9,22 +13,545 @@ import (
 )
 
 var _ = Describe("Framer", func() {
-	rw := new(bytes.Buffer)
-	framer := NewFramer(Spdy3, rw)
+	var (
+		rw     *bytes.Buffer
+		framer *Framer
+	)
 
-	Describe("Should EOF when there are no more frames", func() {
+	BeforeEach(func() {
+		rw = new(bytes.Buffer)
+		framer = NewFramer(Spdy3, rw)
+	})
+
+	It("Should EOF when there are no more frames", func() {
 		_, err := framer.Read()
 		Expect(err).To(Equal(io.EOF))
 	})
 
-	Describe("Should read a simple frame", func() {
+	It("Should read a simple frame", func() {
 		NewHeaderWord(true, Spdy3, SynStreamType).Write(rw)
-		NewFlagLenWord(0, 0).Write(rw)
+		NewFlagLenWord(FlagFin, 10).Write(rw)
 		StreamIdWord(666).Write(rw)
 		StreamIdWord(0).Write(rw)
-		PriorityWord(0).Write(rw)
+		PriorityWord(0x6000).Write(rw)
+
+		frame, err := framer.Read()
+		Expect(err).To(BeNil())
+		Expect(frame).To(Equal(&SynStream{
+			Flags:             FlagFin,
+			StreamId:          666,
+			Priority:          3,
+			Headers:           NameValuePairs{},
+			CompressedHeaders: CompressedNameValuePairs{},
+		}))
+	})
+
+	It("Should read each control frame type", func() {
+		NewHeaderWord(true, Spdy3, RstStreamType).Write(rw)
+		NewFlagLenWord(0, 8).Write(rw)
+		StreamIdWord(3).Write(rw)
+		writeWord(rw, 5)
+
+		NewHeaderWord(true, Spdy3, PingType).Write(rw)
+		NewFlagLenWord(0, 4).Write(rw)
+		writeWord(rw, 42)
+
+		NewHeaderWord(true, Spdy3, GoAwayType).Write(rw)
+		NewFlagLenWord(0, 8).Write(rw)
+		StreamIdWord(7).Write(rw)
+		writeWord(rw, 1)
+
+		NewHeaderWord(true, Spdy3, WindowUpdateType).Write(rw)
+		NewFlagLenWord(0, 8).Write(rw)
+		StreamIdWord(9).Write(rw)
+		StreamIdWord(1024).Write(rw)
+
+		NewHeaderWord(true, Spdy3, SettingsType).Write(rw)
+		NewFlagLenWord(FlagSettingsClearSettings, 4).Write(rw)
+		writeWord(rw, 0)
+
+		Expect(framer.Read()).To(Equal(&RstStream{StreamId: 3, StatusCode: 5}))
+		Expect(framer.Read()).To(Equal(&Ping{Id: 42}))
+		Expect(framer.Read()).To(Equal(&GoAway{
+			LastGoodStreamId: 7,
+			StatusCode:       1,
+		}))
+		Expect(framer.Read()).To(Equal(&WindowUpdate{
+			StreamId:        9,
+			DeltaWindowSize: 1024,
+		}))
+		Expect(framer.Read()).To(Equal(&Settings{
+			Flags:    FlagSettingsClearSettings,
+			Settings: []*Setting{},
+		}))
+	})
+
+	It("Should read a data frame", func() {
+		StreamIdWord(7).Write(rw)
+		NewFlagLenWord(FlagFin, 5).Write(rw)
+		rw.Write([]byte("hello"))
+
+		Expect(framer.Read()).To(Equal(&DataFrame{
+			Flags:    FlagFin,
+			StreamId: 7,
+			Data:     []byte("hello"),
+		}))
+	})
+
+	It("Should fail on a truncated data frame", func() {
+		StreamIdWord(7).Write(rw)
+		NewFlagLenWord(0, 5).Write(rw)
+		rw.Write([]byte("hel"))
+
+		_, err := framer.Read()
+		Expect(err).To(Equal(io.ErrUnexpectedEOF))
+	})
+
+	It("Should ignore unknown control frames", func() {
+		NewHeaderWord(true, Spdy3, FrameType(5)).Write(rw)
+		NewFlagLenWord(0, 2).Write(rw)
+		rw.Write([]byte{0xFF, 0xFF})
+
+		NewHeaderWord(true, Spdy3, PingType).Write(rw)
+		NewFlagLenWord(0, 4).Write(rw)
+		writeWord(rw, 1)
+
+		Expect(framer.Read()).To(Equal(&Ping{Id: 1}))
+	})
+
+	It("Should skip any number of ignored frames", func() {
+		for i := 0; i < 1<<20; i++ {
+			NewHeaderWord(true, Spdy3, FrameType(5)).Write(rw)
+			NewFlagLenWord(0, 0).Write(rw)
+		}
+		NewHeaderWord(true, Spdy3, PingType).Write(rw)
+		NewFlagLenWord(0, 4).Write(rw)
+		writeWord(rw, 1)
+
+		Expect(framer.Read()).To(Equal(&Ping{Id: 1}))
+	})
+
+	It("Should speak SPDY/3.1 as version 3 on the wire", func() {
+		framer = NewFramer(Spdy31, rw)
+		Expect(framer.Write(&Ping{Id: 1})).To(Succeed())
+		Expect(rw.Bytes()[:2]).To(Equal([]byte{0x80, 0x03}))
+	})
+
+	It("Should have no CREDENTIAL frames in SPDY/3.1", func() {
+		framer = NewFramer(Spdy31, rw)
+		Expect(framer.Write(&Credential{Slot: 1})).NotTo(Succeed())
+
+		NewFramer(Spdy3, rw).Write(&Credential{Slot: 1, Proof: []byte("proof")})
+		NewHeaderWord(true, Spdy3, PingType).Write(rw)
+		NewFlagLenWord(0, 4).Write(rw)
+		writeWord(rw, 1)
+
+		Expect(framer.Read()).To(Equal(&Ping{Id: 1}))
+	})
+
+	It("Should fail on a control frame cut off after its header word", func() {
+		NewHeaderWord(true, Spdy3, PingType).Write(rw)
+
+		_, err := framer.Read()
+		Expect(err).To(Equal(io.ErrUnexpectedEOF))
+	})
+
+	It("Should fail on a control frame cut off before its body", func() {
+		NewHeaderWord(true, Spdy3, PingType).Write(rw)
+		NewFlagLenWord(0, 4).Write(rw)
+
+		_, err := framer.Read()
+		Expect(err).To(Equal(io.ErrUnexpectedEOF))
+	})
+
+	It("Should fail on a truncated frame body", func() {
+		NewHeaderWord(true, Spdy3, RstStreamType).Write(rw)
+		NewFlagLenWord(0, 4).Write(rw)
+		StreamIdWord(3).Write(rw)
+
+		_, err := framer.Read()
+		Expect(err).To(Equal(io.ErrUnexpectedEOF))
+	})
+
+	It("Should end the session over an oversized header block", func() {
+		value := string(bytes.Repeat([]byte("x"), MaxHeaderBlockSize))
+		Expect(framer.Write(&SynStream{
+			StreamId: 1,
+			Headers:  NameValuePairs{"x": {value}},
+		})).To(Succeed())
+
+		_, err := framer.Read()
+		var sessionErr *SessionError
+		Expect(errors.As(err, &sessionErr)).To(BeTrue())
+		Expect(sessionErr.StatusCode).To(Equal(GoAwayProtocolError))
+	})
+
+	It("Should reject SETTINGS counting more entries than they hold", func() {
+		for _, version := range []SpdyVersion{Spdy2, Spdy3} {
+			NewHeaderWord(true, version, SettingsType).Write(rw)
+			NewFlagLenWord(0, 12).Write(rw)
+			writeWord(rw, 0xFFFFFFFF)
+			writeWord(rw, 1)
+			writeWord(rw, 2)
+
+			_, err := NewFramer(version, rw).Read()
+			var sessionErr *SessionError
+			Expect(errors.As(err, &sessionErr)).To(BeTrue())
+			Expect(sessionErr.StatusCode).To(Equal(GoAwayProtocolError))
+		}
+	})
+
+	It("Should surface bad header blocks as stream errors", func() {
+		// The framer will not write a bad block, so compress one by hand
+		block := new(bytes.Buffer)
+		writeWord(block, 1)
+		writeBytes(block, []byte("Bad"))
+		writeBytes(block, []byte("header"))
+		framer.compressor.w.Write(block.Bytes())
+		framer.compressor.w.Flush()
+		body := new(bytes.Buffer)
+		(&SynStream{
+			StreamId:          3,
+			CompressedHeaders: framer.compressor.buf.Bytes(),
+		}).Write(body)
+		framer.compressor.buf.Reset()
+		NewHeaderWord(true, Spdy3, SynStreamType).Write(rw)
+		NewFlagLenWord(0, uint32(body.Len())).Write(rw)
+		body.WriteTo(rw)
+
+		Expect(framer.Write(&SynStream{
+			StreamId: 5,
+			Headers:  NameValuePairs{"good": {"header"}},
+		})).To(Succeed())
+
+		_, err := framer.Read()
+		Expect(err).To(BeAssignableToTypeOf(&StreamError{}))
+		Expect(err.(*StreamError).StreamId).To(Equal(uint32(3)))
+		Expect(err.(*StreamError).StatusCode).To(Equal(ProtocolError))
+
+		// The compression context should still be intact
+		frame, err := framer.Read()
+		Expect(err).To(BeNil())
+		Expect(frame.(*SynStream).Headers).To(Equal(
+			NameValuePairs{"good": {"header"}}))
+	})
+
+	It("Should refuse to write bad header blocks", func() {
+		for _, headers := range []NameValuePairs{
+			{"Bad": {"header"}},
+			{"": {"header"}},
+			{"bad": {"head\x00er"}},
+			{"bad": {"", "header"}},
+		} {
+			err := framer.Write(&SynStream{StreamId: 3, Headers: headers})
+			Expect(err).To(BeAssignableToTypeOf(&StreamError{}))
+			Expect(err.(*StreamError).StreamId).To(Equal(uint32(3)))
+			Expect(err.(*StreamError).StatusCode).To(Equal(ProtocolError))
+		}
+		Expect(rw.Len()).To(Equal(0))
+
+		// Nothing reached the compression context either
+		Expect(framer.Write(&SynStream{
+			StreamId: 5,
+			Headers:  NameValuePairs{"good": {"header"}},
+		})).To(Succeed())
+		frame, err := framer.Read()
+		Expect(err).To(BeNil())
+		Expect(frame.(*SynStream).Headers).To(Equal(
+			NameValuePairs{"good": {"header"}}))
+	})
+
+	Describe("Round trips", func() {
+		frames := []Frame{
+			&SynStream{
+				Flags:              FlagFin | FlagUnidirectional,
+				StreamId:           1,
+				AssociatedStreamId: 2,
+				Priority:           7,
+				Slot:               3,
+				Headers:            NameValuePairs{":path": {"/"}, ":method": {"GET"}},
+			},
+			&SynReply{
+				Flags:    FlagFin,
+				StreamId: 1,
+				Headers:  NameValuePairs{":status": {"200"}},
+			},
+			&RstStream{StreamId: 3, StatusCode: 5},
+			&Settings{
+				Flags: FlagSettingsClearSettings,
+				Settings: []*Setting{
+					{Flags: 1, Id: 4, Value: 100},
+					{Flags: 0, Id: 7, Value: 65536},
+				},
+			},
+			&Ping{Id: 99},
+			&GoAway{LastGoodStreamId: 5, StatusCode: 2},
+			&Headers{
+				StreamId: 5,
+				Headers:  NameValuePairs{},
+			},
+			&WindowUpdate{StreamId: 5, DeltaWindowSize: 0x7FFFFFFF},
+			&Credential{
+				Slot:         1,
+				Proof:        []byte{0x0A, 0x0B},
+				Certificates: [][]byte{{0x01}, {0x02, 0x03}},
+			},
+			&DataFrame{Flags: FlagFin, StreamId: 5, Data: []byte("payload")},
+			&DataFrame{StreamId: 0x7FFFFFFF, Data: []byte{}},
+		}
+
+		It("should cover every frame type", func() {
+			seen := make(map[FrameType]bool)
+			for _, frame := range frames {
+				seen[frame.Type()] = true
+			}
+			for _, typ := range []FrameType{
+				SynStreamType, SynReplyType, RstStreamType, SettingsType, PingType,
+				GoAwayType, HeadersType, WindowUpdateType, CredentialType,
+			} {
+				Expect(seen).To(HaveKey(typ))
+			}
+		})
+
+		It("should read back exactly what was written", func() {
+			for _, frame := range frames {
+				Expect(framer.Write(frame)).To(Succeed())
+			}
+			for _, frame := range frames {
+				Expect(framer.Read()).To(Equal(frame))
+			}
+			_, err := framer.Read()
+			Expect(err).To(Equal(io.EOF))
+		})
+
+		It("should write the correct frame length", func() {
+			Expect(framer.Write(&RstStream{StreamId: 3, StatusCode: 5})).To(Succeed())
+			Expect(rw.Bytes()).To(Equal([]byte{
+				0x80, 0x03, 0x00, 0x03, // |1|   version    |         3       |
+				0x00, 0x00, 0x00, 0x08, // | Flags (8)  |         8           |
+				0x00, 0x00, 0x00, 0x03, // |X|          Stream-ID (31bits)    |
+				0x00, 0x00, 0x00, 0x05, // |          Status code             |
+			}))
+		})
+
+		It("should write a data frame header", func() {
+			Expect(framer.Write(&DataFrame{
+				Flags:    FlagFin,
+				StreamId: 3,
+				Data:     []byte{0xAA},
+			})).To(Succeed())
+			Expect(rw.Bytes()).To(Equal([]byte{
+				0x00, 0x00, 0x00, 0x03, // |C|       Stream-ID (31bits)       |
+				0x01, 0x00, 0x00, 0x01, // | Flags (8)  |  Length (24 bits)   |
+				0xAA, // |               Data               |
+			}))
+		})
+
+		It("should refuse frames larger than 24 bits of length", func() {
+			err := framer.Write(&DataFrame{
+				StreamId: 1,
+				Data:     make([]byte, MaxFrameLength+1),
+			})
+			Expect(err).To(Equal(ErrFrameTooLarge))
+			Expect(rw.Len()).To(Equal(0))
+		})
+	})
+})
+
+var _ = Describe("SPDY/2 Framer", func() {
+	var (
+		rw     *bytes.Buffer
+		framer *Framer
+	)
+
+	BeforeEach(func() {
+		rw = new(bytes.Buffer)
+		framer = NewFramer(Spdy2, rw)
+	})
+
+	It("Should use the SPDY/2 dictionary", func() {
+		Expect(adler32.Checksum(spdy2Dictionary)).To(Equal(uint32(0xdfa251b2)))
+	})
+
+	It("Should read back exactly what was written", func() {
+		frames := []Frame{
+			&SynStream{
+				Flags:              FlagFin,
+				StreamId:           1,
+				AssociatedStreamId: 2,
+				Priority:           6,
+				Headers:            NameValuePairs{":path": {"/"}, ":method": {"GET"}},
+			},
+			&SynReply{
+				StreamId: 1,
+				Headers:  NameValuePairs{":status": {"200 OK"}, ":version": {"HTTP/1.1"}},
+			},
+			&Headers{StreamId: 1, Headers: NameValuePairs{"x-trailer": {"a", "b"}}},
+			&Settings{Settings: []*Setting{{Flags: 1, Id: 4, Value: 100}}},
+			&GoAway{LastGoodStreamId: 5, StatusCode: GoAwayOK},
+			&Noop{},
+			&Ping{Id: 99},
+		}
+		for _, frame := range frames {
+			Expect(framer.Write(frame)).To(Succeed())
+		}
+		for _, frame := range frames {
+			Expect(framer.Read()).To(Equal(frame))
+		}
+	})
+
+	It("Should send priorities in two bits", func() {
+		Expect(framer.Write(&SynStream{StreamId: 1, Priority: 5})).To(Succeed())
+		Expect(rw.Bytes()[:2]).To(Equal([]byte{0x80, 0x02}))
+		Expect(rw.Bytes()[16:18]).To(Equal([]byte{0x80, 0x00}))
+
+		frame, err := framer.Read()
+		Expect(err).To(BeNil())
+		Expect(frame.(*SynStream).Priority).To(Equal(uint8(4)))
+	})
+
+	It("Should send unprefixed header names with 16 bit lengths", func() {
+		Expect(framer.Write(&SynReply{
+			StreamId: 1,
+			Headers:  NameValuePairs{":status": {"200 OK"}},
+		})).To(Succeed())
+
+		// Skip the frame header, stream id and unused bits
+		headers, err := newHeaderDecompressor(Spdy2).Decompress(rw.Bytes()[14:])
+		Expect(err).To(BeNil())
+		Expect(headers).To(Equal(NameValuePairs{"status": {"200 OK"}}))
+
+		var raw bytes.Buffer
+		Expect(headers.write(&raw, Spdy2)).To(Equal(18))
+		Expect(raw.Bytes()[:4]).To(Equal([]byte{0x00, 0x01, 0x00, 0x06}))
+	})
+
+	It("Should send settings ids in little endian order", func() {
+		Expect(framer.Write(&Settings{Settings: []*Setting{
+			{Flags: FlagSettingsPersistValue, Id: SettingsMaxConcurrentStreams, Value: 100},
+		}})).To(Succeed())
+		Expect(rw.Bytes()[8:]).To(Equal([]byte{
+			0x00, 0x00, 0x00, 0x01,
+			0x04, 0x00, 0x00, 0x01, // | ID (24 bits, little endian) | Flags (8) |
+			0x00, 0x00, 0x00, 0x64,
+		}))
+	})
+
+	It("Should send GOAWAY without a status", func() {
+		Expect(framer.Write(&GoAway{LastGoodStreamId: 3})).To(Succeed())
+		Expect(rw.Bytes()).To(Equal([]byte{
+			0x80, 0x02, 0x00, 0x07,
+			0x00, 0x00, 0x00, 0x04,
+			0x00, 0x00, 0x00, 0x03,
+		}))
+	})
+
+	It("Should only have NOOP frames in SPDY/2", func() {
+		Expect(NewFramer(Spdy3, rw).Write(&Noop{})).NotTo(Succeed())
+		Expect(framer.Write(&Credential{Slot: 1})).NotTo(Succeed())
+	})
+})
+
+var _ = Describe("Version mismatches", func() {
+	var (
+		rw     *bytes.Buffer
+		framer *Framer
+	)
+
+	BeforeEach(func() {
+		rw = new(bytes.Buffer)
+		framer = NewFramer(Spdy3, rw)
+	})
+
+	// Any version can lay out each frame type, as only the header word is
+	// looked at before the body is skipped.
+	frameTypes := []FrameType{
+		SynStreamType, SynReplyType, RstStreamType, SettingsType, NoopType,
+		PingType, GoAwayType, HeadersType, WindowUpdateType, CredentialType,
+	}
+
+	for _, version := range []SpdyVersion{2, 4, 0x83, 0x7FFF} {
+		version := version
+		for _, typ := range frameTypes {
+			typ := typ
+
+			It(fmt.Sprintf("Should refuse a version %d frame of type %d", version, typ), func() {
+				NewHeaderWord(true, version, typ).Write(rw)
+				NewFlagLenWord(0, 8).Write(rw)
+				StreamIdWord(5).Write(rw)
+				writeWord(rw, 0)
+
+				NewHeaderWord(true, Spdy3, PingType).Write(rw)
+				NewFlagLenWord(0, 4).Write(rw)
+				writeWord(rw, 1)
+
+				_, err := framer.Read()
+				Expect(err).To(BeAssignableToTypeOf(&VersionError{}))
+				versionErr := err.(*VersionError)
+				Expect(versionErr.Version).To(Equal(version))
+				Expect(versionErr.Expected).To(Equal(Spdy3))
+				Expect(versionErr.Type).To(Equal(typ))
+
+				var streamErr *StreamError
+				var sessionErr *SessionError
+				if typ == SynStreamType {
+					Expect(errors.As(err, &streamErr)).To(BeTrue())
+					Expect(streamErr.StreamId).To(Equal(uint32(5)))
+					Expect(streamErr.StatusCode).To(Equal(UnsupportedVersion))
+				} else {
+					Expect(errors.As(err, &sessionErr)).To(BeTrue())
+					Expect(sessionErr.StatusCode).To(Equal(GoAwayProtocolError))
+				}
+
+				// The mismatched frame's body should have been skipped
+				Expect(framer.Read()).To(Equal(&Ping{Id: 1}))
+			})
+		}
+	}
+
+	It("Should keep decompressing headers past a SYN_STREAM of another version", func() {
+		headers := NameValuePairs{":path": {"/"}}
+		Expect(framer.Write(&SynStream{StreamId: 1, Headers: headers})).To(Succeed())
+		binary.BigEndian.PutUint16(rw.Bytes(), 0x8000|2)
+		Expect(framer.Write(&SynStream{StreamId: 3, Headers: headers})).To(Succeed())
 
 		_, err := framer.Read()
+		var streamErr *StreamError
+		Expect(errors.As(err, &streamErr)).To(BeTrue())
+		Expect(streamErr.StatusCode).To(Equal(UnsupportedVersion))
+
+		frame, err := framer.Read()
 		Expect(err).To(BeNil())
+		Expect(frame.(*SynStream).Headers).To(Equal(headers))
+	})
+
+	It("Should end the session if it cannot decompress a SYN_STREAM of another version", func() {
+		Expect(NewFramer(Spdy2, rw).Write(&SynStream{
+			StreamId: 1,
+			Headers:  NameValuePairs{":path": {"/"}},
+		})).To(Succeed())
+
+		_, err := framer.Read()
+		Expect(err).To(BeAssignableToTypeOf(&SessionError{}))
+		Expect(err.(*SessionError).StatusCode).To(Equal(GoAwayProtocolError))
+	})
+
+	It("Should expect version 3 frames when speaking SPDY/3.1", func() {
+		framer = NewFramer(Spdy31, rw)
+		NewHeaderWord(true, Spdy3, PingType).Write(rw)
+		NewFlagLenWord(0, 4).Write(rw)
+		writeWord(rw, 1)
+		Expect(framer.Read()).To(Equal(&Ping{Id: 1}))
+	})
+
+	It("Should refuse version 3 frames when speaking SPDY/2", func() {
+		framer = NewFramer(Spdy2, rw)
+		NewHeaderWord(true, Spdy3, PingType).Write(rw)
+		NewFlagLenWord(0, 4).Write(rw)
+		writeWord(rw, 1)
+
+		_, err := framer.Read()
+		Expect(err).To(BeAssignableToTypeOf(&VersionError{}))
+		Expect(err.(*VersionError).Expected).To(Equal(Spdy2))
 	})
 })
@@ -1,21 +1,27 @@
 package spdy3
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"sort"
+	"strings"
 	"unsafe"
 )
 
 type FrameType uint16
 
+// Data frames carry no type on the wire, DataFrameType only exists so they can
+// satisfy the Frame interface.
 const (
-	_                       = iota
-	SynStreamType FrameType = iota
+	DataFrameType FrameType = iota
+	SynStreamType
 	SynReplyType
 	RstStreamType
 	SettingsType
-	_
+	NoopType // SPDY/2 only
 	PingType
 	GoAwayType
 	HeadersType
@@ -23,16 +29,44 @@ const (
 	CredentialType
 )
 
+// Control frame flags. The meaning of a flag depends on the frame type it is
+// set on, so a number of these share the same value.
+const (
+	FlagFin                   uint8 = 0x01
+	FlagUnidirectional        uint8 = 0x02
+	FlagSettingsClearSettings uint8 = 0x01
+)
+
 type SpdyVersion uint16
 
 const (
+	Spdy2 SpdyVersion = 2
 	Spdy3 SpdyVersion = 3
+
+	// SPDY/3.1 frames are those of SPDY/3, and carry the same version number,
+	// but a WINDOW_UPDATE for stream 0 moves a flow control window covering the
+	// whole session. The CREDENTIAL frame is gone.
+	Spdy31 SpdyVersion = 0x0301
 )
 
+// wire is the version number frames of this version carry.
+func (v SpdyVersion) wire() SpdyVersion {
+	if v == Spdy31 {
+		return Spdy3
+	}
+	return v
+}
+
 type Frame interface {
 	Type() FrameType
 }
 
+// spdy2Frame is a control frame whose body is laid out differently in SPDY/2.
+type spdy2Frame interface {
+	readV2(r io.Reader) (int, error)
+	writeV2(w io.Writer) (int, error)
+}
+
 // ----------------------------------------------------------------------------
 // Header Word
 //  +----------------------------------+
@@ -47,7 +81,7 @@ func NewHeaderWord(control bool, version SpdyVersion, typ FrameType) HeaderWord
 		header |= 0x80000000
 	}
 
-	header |= HeaderWord(uint32(version&0x7f) << 16)
+	header |= HeaderWord(uint32(version.wire()&0x7FFF) << 16)
 	header |= HeaderWord(uint32(typ) & 0xff)
 	return header
 }
@@ -60,8 +94,8 @@ func (h HeaderWord) Control() bool {
 
 // Version: The version number of the SPDY protocol. This document describes
 // SPDY version 3.
-func (h HeaderWord) Version() SpdyVersion /* TODO uint16 */ {
-	return SpdyVersion((h >> 16) & 0x7F)
+func (h HeaderWord) Version() SpdyVersion {
+	return SpdyVersion((h >> 16) & 0x7FFF)
 }
 
 // Type: The type of control frame. See Control Frames (Section 2.6) for the
@@ -84,7 +118,7 @@ type FlagLenWord uint32
 
 func NewFlagLenWord(flags uint8, length uint32) FlagLenWord {
 	var flagLenWord FlagLenWord
-	flagLenWord |= FlagLenWord(flags << 24)
+	flagLenWord |= FlagLenWord(uint32(flags) << 24)
 	flagLenWord |= FlagLenWord(length & 0x00ffffff)
 	return flagLenWord
 }
@@ -125,27 +159,59 @@ func (s StreamIdWord) Write(w io.Writer) (int, error) {
 
 // ----------------------------------------------------------------------------
 // Priority Word
-// As a note, this current doesn't grok "slot" because the credentials bit of
-// things is pending.
+// Only the first 16 bits of the row belong to the priority word, the remainder
+// is the start of the header block. The slot names an entry in the server's
+// vector of client certificates, sent in CREDENTIAL frames, or is 0 for none.
 //
-//  +------------------------------------+
-//  | Pri|Unused | Slot |                |
-//  +-------------------+----------------+
-type PriorityWord uint32
+//  +-------------------+
+//  | Pri|Unused | Slot |
+//  +-------------------+
+type PriorityWord uint16
 
 func (p *PriorityWord) Read(r io.Reader) (int, error) {
 	if err := binary.Read(r, binary.BigEndian, p); err != nil {
 		return 0, err
 	}
-	return 4, nil
+	return 2, nil
 }
 
 func (p PriorityWord) Priority() uint8 {
-	return uint8(p >> 29)
+	return uint8(p >> 13)
+}
+
+func (p PriorityWord) Slot() uint8 {
+	return uint8(p & 0xFF)
 }
 
 func (p PriorityWord) Write(w io.Writer) (int, error) {
-	return writeWord(w, uint32(p))
+	return writeHalfWord(w, uint16(p))
+}
+
+// ----------------------------------------------------------------------------
+// Flag/Id Word
+// Each entry of a SETTINGS frame leads with a word much like the Flag/Len Word,
+// which SPDY/3 sends in network byte order: the flags are the high byte, and
+// the id the low 24 bits. (SPDY/2 differed here.)
+//
+//  +----------------------------------+
+//  | Flags(8) |      ID (24 bits)     |
+//  +----------------------------------+
+type FlagIdWord uint32
+
+func NewFlagIdWord(flags uint8, id SettingsId) FlagIdWord {
+	return FlagIdWord(uint32(flags)<<24 | uint32(id)&0x00FFFFFF)
+}
+
+func (f FlagIdWord) Flags() uint8 {
+	return uint8(f >> 24)
+}
+
+func (f FlagIdWord) Id() SettingsId {
+	return SettingsId(f & 0x00FFFFFF)
+}
+
+func (f FlagIdWord) Write(w io.Writer) (int, error) {
+	return writeWord(w, uint32(f))
 }
 
 // ----------------------------------------------------------------------------
@@ -181,58 +247,181 @@ func (p PriorityWord) Write(w io.Writer) (int, error) {
 //  |          Value   (string)          |    |
 //  +------------------------------------+    |
 //  |           (repeats)                |   <+
-type NameValuePairs map[string]string
+//
+// Multiple values for a single name are kept as separate entries, much like an
+// http.Header, and are only joined with NUL bytes on the wire.
+//
+// SPDY/2 header blocks are the same, but with 16 bit counts and lengths.
+type NameValuePairs map[string][]string
+
+// Get returns the first value associated with the given name, or "" if there
+// is none.
+func (nvp NameValuePairs) Get(name string) string {
+	if values := nvp[strings.ToLower(name)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
 
+// Set replaces any existing values of name with a single value.
+func (nvp NameValuePairs) Set(name, value string) {
+	nvp[strings.ToLower(name)] = []string{value}
+}
+
+// Add appends a value to any existing values of name.
+func (nvp NameValuePairs) Add(name, value string) {
+	name = strings.ToLower(name)
+	nvp[name] = append(nvp[name], value)
+}
+
+// Del removes all values of name.
+func (nvp NameValuePairs) Del(name string) {
+	delete(nvp, strings.ToLower(name))
+}
+
+// Read decodes a header block into nvp. The whole block is always consumed, as
+// it may be one of many in a compression context. If the block was readable but
+// broke one of the rules above, the first violation is returned as a
+// *StreamError with a PROTOCOL_ERROR status after reading it.
 func (nvp NameValuePairs) Read(r io.Reader) (n int, err error) {
+	return nvp.read(r, Spdy3)
+}
+
+func (nvp NameValuePairs) read(r io.Reader, version SpdyVersion) (n int, err error) {
 	var numPairs, length uint32
 	var name, value []byte
+	var invalid error
+	var i int
 
-	if err = binary.Read(r, binary.BigEndian, &numPairs); err != nil {
+	if numPairs, i, err = readLength(r, version); err != nil {
 		return
 	}
-	n += 4
+	n += i
 
-	for i := uint32(0); i < numPairs; i++ {
-		if err = binary.Read(r, binary.BigEndian, &length); err != nil {
+	for p := uint32(0); p < numPairs; p++ {
+		if length, i, err = readLength(r, version); err != nil {
 			return
 		}
-		n += 4 + int(length)
+		if err = checkHeaderLength(r, length); err != nil {
+			return
+		}
+		n += i + int(length)
 
 		name = make([]byte, length)
-		if _, err = r.Read(name); err != nil {
+		if _, err = io.ReadFull(r, name); err != nil {
 			return
 		}
 
-		if err = binary.Read(r, binary.BigEndian, &length); err != nil {
+		if length, i, err = readLength(r, version); err != nil {
+			return
+		}
+		if err = checkHeaderLength(r, length); err != nil {
 			return
 		}
-		n += 4 + int(length)
+		n += i + int(length)
 
 		value = make([]byte, length)
-		if _, err = r.Read(value); err != nil {
+		if _, err = io.ReadFull(r, value); err != nil {
 			return
 		}
 
-		nvp[string(name)] = string(value)
+		if invalid == nil {
+			invalid = nvp.validate(name, value)
+		}
+
+		key := string(name)
+		if _, ok := nvp[key]; !ok {
+			nvp[key] = strings.Split(string(value), "\x00")
+		}
 	}
 
-	return
+	return n, invalid
+}
+
+// checkHeaderLength makes sure a name or value of length bytes is short enough
+// to make room for.
+func checkHeaderLength(r io.Reader, length uint32) error {
+	if length > MaxFrameLength {
+		return ErrFrameTooLarge
+	}
+	if b, ok := r.(*headerBlockReader); ok && int(length) > b.left {
+		return ErrHeaderBlockTooLarge
+	}
+	return nil
+}
+
+// validate checks a single name and value as they come off the wire against
+// the pairs which have been read so far.
+func (nvp NameValuePairs) validate(name, value []byte) error {
+	if len(name) == 0 {
+		return protocolError("zero-length header name")
+	}
+	for _, c := range name {
+		if c >= 'A' && c <= 'Z' {
+			return protocolError("header name %q is not lower case", name)
+		}
+	}
+	if _, ok := nvp[string(name)]; ok {
+		return protocolError("duplicate header name %q", name)
+	}
+
+	if len(value) == 0 {
+		return nil
+	}
+	if value[0] == 0 || value[len(value)-1] == 0 {
+		return protocolError("value of %q starts or ends with NUL", name)
+	}
+	if bytes.Contains(value, []byte{0, 0}) {
+		return protocolError("value of %q has an empty segment", name)
+	}
+	return nil
 }
 
 func (nvp *NameValuePairs) Write(w io.Writer) (n int, err error) {
+	return nvp.write(w, Spdy3)
+}
+
+// write encodes the block, after checking it against the same rules as Read.
+// A block which breaks them is not written at all, and the first violation is
+// returned as a *StreamError with a PROTOCOL_ERROR status.
+func (nvp *NameValuePairs) write(w io.Writer, version SpdyVersion) (n int, err error) {
 	var i int
 
-	if err = binary.Write(w, binary.BigEndian, uint32(len(*nvp))); err != nil {
+	// Write names in a stable order, which keeps the output deterministic and
+	// gives the compressor a better chance at repeated blocks.
+	names := make([]string, 0, len(*nvp))
+	for name := range *nvp {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Check the whole block first, so a bad one leaves the compression context
+	// untouched
+	for _, name := range names {
+		values := (*nvp)[name]
+		for _, value := range values {
+			if strings.IndexByte(value, 0) >= 0 {
+				return 0, protocolError("value of %q contains NUL", name)
+			}
+		}
+		value := strings.Join(values, "\x00")
+		if err = NameValuePairs(nil).validate([]byte(name), []byte(value)); err != nil {
+			return
+		}
+	}
+
+	if i, err = writeLength(w, version, len(*nvp)); err != nil {
 		return
 	}
-	n += 4
+	n += i
 
-	for name, value := range *nvp {
-		if i, err = nvp.writeString(w, []byte(name)); err != nil {
+	for _, name := range names {
+		value := strings.Join((*nvp)[name], "\x00")
+		if i, err = nvp.writeString(w, version, []byte(name)); err != nil {
 			return
 		}
 		n += i
-		if i, err = nvp.writeString(w, []byte(value)); err != nil {
+		if i, err = nvp.writeString(w, version, []byte(value)); err != nil {
 			return
 		}
 		n += i
@@ -241,14 +430,13 @@ func (nvp *NameValuePairs) Write(w io.Writer) (n int, err error) {
 	return
 }
 
-func (nvp *NameValuePairs) writeString(w io.Writer, s []byte) (n int, err error) {
+func (nvp *NameValuePairs) writeString(w io.Writer, version SpdyVersion, s []byte) (n int, err error) {
 	var i int
-	var length = uint32(len(s))
 
-	if err = binary.Write(w, binary.BigEndian, length); err != nil {
+	if i, err = writeLength(w, version, len(s)); err != nil {
 		return
 	}
-	n += 4
+	n += i
 
 	if i, err = w.Write(s); err != nil {
 		return
@@ -261,9 +449,17 @@ func (nvp *NameValuePairs) writeString(w io.Writer, s []byte) (n int, err error)
 // Compressed Name/Value Pairs
 //
 // Name/Value pairs are compressed by default. This type referrs to the
-// compressed value
+// compressed value. The Framer owns the compression context for a connection,
+// and fills in the decoded headers of a frame as it is read, and compresses
+// them as it is written.
 type CompressedNameValuePairs []byte
 
+// headerFrame is a frame which carries a Name/Value header block.
+type headerFrame interface {
+	streamId() uint32
+	headerBlock() (*NameValuePairs, *CompressedNameValuePairs)
+}
+
 // ----------------------------------------------------------------------------
 // SYN_STREAM
 //
@@ -293,9 +489,12 @@ type CompressedNameValuePairs []byte
 //  +------------------------------------+    |
 //  |           (repeats)                |   <+
 type SynStream struct {
+	Flags              uint8
 	StreamId           uint32
 	AssociatedStreamId uint32
 	Priority           uint8
+	Slot               uint8
+	Headers            NameValuePairs
 	CompressedHeaders  CompressedNameValuePairs
 }
 
@@ -315,6 +514,7 @@ func (s *SynStream) Read(r io.Reader) (n int, err error) {
 	s.StreamId = frame.StreamId.StreamId()
 	s.AssociatedStreamId = frame.AssociatedStreamId.StreamId()
 	s.Priority = frame.Priority.Priority()
+	s.Slot = frame.Priority.Slot()
 	s.CompressedHeaders, err = ioutil.ReadAll(r)
 	return
 }
@@ -323,6 +523,62 @@ func (s *SynStream) Type() FrameType {
 	return SynStreamType
 }
 
+func (s *SynStream) Write(w io.Writer) (n int, err error) {
+	frame := &synStreamFramev3{
+		StreamId:           StreamIdWord(s.StreamId & 0x7FFFFFFF),
+		AssociatedStreamId: StreamIdWord(s.AssociatedStreamId & 0x7FFFFFFF),
+		Priority:           PriorityWord(uint16(s.Priority&0x07)<<13 | uint16(s.Slot)),
+	}
+	if err = binary.Write(w, binary.BigEndian, frame); err != nil {
+		return
+	}
+	n += binary.Size(frame)
+
+	i, err := w.Write(s.CompressedHeaders)
+	n += i
+	return
+}
+
+// SPDY/2 has the same layout, but only the top two bits of the priority word
+// are the priority, and there is no slot. Each of its four priorities stands
+// for two of ours.
+func (s *SynStream) readV2(r io.Reader) (n int, err error) {
+	if n, err = s.Read(r); err != nil {
+		return
+	}
+	s.Priority = (s.Priority >> 1) << 1
+	s.Slot = 0
+	return
+}
+
+func (s *SynStream) writeV2(w io.Writer) (n int, err error) {
+	frame := &synStreamFramev3{
+		StreamId:           StreamIdWord(s.StreamId & 0x7FFFFFFF),
+		AssociatedStreamId: StreamIdWord(s.AssociatedStreamId & 0x7FFFFFFF),
+		Priority:           PriorityWord(uint16(s.Priority>>1&0x03) << 14),
+	}
+	if err = binary.Write(w, binary.BigEndian, frame); err != nil {
+		return
+	}
+	n += binary.Size(frame)
+
+	i, err := w.Write(s.CompressedHeaders)
+	n += i
+	return
+}
+
+func (s *SynStream) flags() uint8 {
+	return s.Flags
+}
+
+func (s *SynStream) streamId() uint32 {
+	return s.StreamId
+}
+
+func (s *SynStream) headerBlock() (*NameValuePairs, *CompressedNameValuePairs) {
+	return &s.Headers, &s.CompressedHeaders
+}
+
 // Ensure SynStream is a frame
 var _ Frame = &SynStream{}
 
@@ -351,7 +607,9 @@ var _ Frame = &SynStream{}
 //  +------------------------------------+    |
 //  |           (repeats)                |   <+
 type SynReply struct {
+	Flags             uint8
 	StreamId          uint32
+	Headers           NameValuePairs
 	CompressedHeaders CompressedNameValuePairs
 }
 
@@ -359,6 +617,12 @@ type synReplyFramev3 struct {
 	StreamId StreamIdWord
 }
 
+// SPDY/2 puts 16 unused bits ahead of the header block.
+type synReplyFramev2 struct {
+	StreamId StreamIdWord
+	Unused   uint16
+}
+
 func (s SynReply) Type() FrameType {
 	return SynReplyType
 }
@@ -375,6 +639,59 @@ func (s *SynReply) Read(r io.Reader) (n int, err error) {
 	return
 }
 
+func (s *SynReply) Write(w io.Writer) (n int, err error) {
+	frame := &synReplyFramev3{
+		StreamId: StreamIdWord(s.StreamId & 0x7FFFFFFF),
+	}
+	if err = binary.Write(w, binary.BigEndian, frame); err != nil {
+		return
+	}
+	n += binary.Size(frame)
+
+	i, err := w.Write(s.CompressedHeaders)
+	n += i
+	return
+}
+
+func (s *SynReply) readV2(r io.Reader) (n int, err error) {
+	frame := new(synReplyFramev2)
+	if err = binary.Read(r, binary.BigEndian, frame); err != nil {
+		return
+	}
+	n += binary.Size(frame)
+
+	s.StreamId = frame.StreamId.StreamId()
+	s.CompressedHeaders, err = ioutil.ReadAll(r)
+	n += len(s.CompressedHeaders)
+	return
+}
+
+func (s *SynReply) writeV2(w io.Writer) (n int, err error) {
+	frame := &synReplyFramev2{
+		StreamId: StreamIdWord(s.StreamId & 0x7FFFFFFF),
+	}
+	if err = binary.Write(w, binary.BigEndian, frame); err != nil {
+		return
+	}
+	n += binary.Size(frame)
+
+	i, err := w.Write(s.CompressedHeaders)
+	n += i
+	return
+}
+
+func (s *SynReply) flags() uint8 {
+	return s.Flags
+}
+
+func (s *SynReply) streamId() uint32 {
+	return s.StreamId
+}
+
+func (s *SynReply) headerBlock() (*NameValuePairs, *CompressedNameValuePairs) {
+	return &s.Headers, &s.CompressedHeaders
+}
+
 // Ensure SynReply is a frame
 var _ Frame = &SynReply{}
 
@@ -397,13 +714,14 @@ var _ Frame = &SynReply{}
 //  |          Status code             |
 //  +----------------------------------+
 type RstStream struct {
+	Flags      uint8
 	StreamId   uint32
-	StatusCode int32
+	StatusCode RstStreamStatus
 }
 
 type rstStreamFramev3 struct {
 	StreamId   StreamIdWord
-	StatusCode int32
+	StatusCode RstStreamStatus
 }
 
 func (rst RstStream) Type() FrameType {
@@ -422,6 +740,22 @@ func (rst *RstStream) Read(r io.Reader) (n int, err error) {
 	return
 }
 
+func (rst *RstStream) Write(w io.Writer) (n int, err error) {
+	frame := &rstStreamFramev3{
+		StreamId:   StreamIdWord(rst.StreamId & 0x7FFFFFFF),
+		StatusCode: rst.StatusCode,
+	}
+	if err = binary.Write(w, binary.BigEndian, frame); err != nil {
+		return
+	}
+	n += binary.Size(frame)
+	return
+}
+
+func (rst *RstStream) flags() uint8 {
+	return rst.Flags
+}
+
 // Ensure RstStream is a frame
 var _ Frame = &RstStream{}
 
@@ -445,20 +779,120 @@ var _ Frame = &RstStream{}
 //  |          ID/Value Pairs          |
 //  |             ...                  |
 type Settings struct {
+	Flags    uint8
 	Settings []*Setting
 }
 
+//  +----------------------------------+
+//  | Flags(8) |      ID (24 bits)     |
+//  +----------------------------------+
+//  |          Value (32 bits)         |
+//  +----------------------------------+
 type Setting struct {
 	Flags uint8
-	Id    uint32
+	Id    SettingsId
 	Value int32
 }
 
+type SettingsId uint32
+
+const (
+	SettingsUploadBandwidth             SettingsId = 1
+	SettingsDownloadBandwidth           SettingsId = 2
+	SettingsRoundTripTime               SettingsId = 3
+	SettingsMaxConcurrentStreams        SettingsId = 4
+	SettingsCurrentCwnd                 SettingsId = 5
+	SettingsDownloadRetransRate         SettingsId = 6
+	SettingsInitialWindowSize           SettingsId = 7
+	SettingsClientCertificateVectorSize SettingsId = 8
+)
+
+var settingsIdNames = map[SettingsId]string{
+	SettingsUploadBandwidth:             "SETTINGS_UPLOAD_BANDWIDTH",
+	SettingsDownloadBandwidth:           "SETTINGS_DOWNLOAD_BANDWIDTH",
+	SettingsRoundTripTime:               "SETTINGS_ROUND_TRIP_TIME",
+	SettingsMaxConcurrentStreams:        "SETTINGS_MAX_CONCURRENT_STREAMS",
+	SettingsCurrentCwnd:                 "SETTINGS_CURRENT_CWND",
+	SettingsDownloadRetransRate:         "SETTINGS_DOWNLOAD_RETRANS_RATE",
+	SettingsInitialWindowSize:           "SETTINGS_INITIAL_WINDOW_SIZE",
+	SettingsClientCertificateVectorSize: "SETTINGS_CLIENT_CERTIFICATE_VECTOR_SIZE",
+}
+
+func (id SettingsId) String() string {
+	if name, ok := settingsIdNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("SETTINGS id %d", uint32(id))
+}
+
+// Flags of a single setting, as opposed to FlagSettingsClearSettings which
+// belongs to the whole frame.
+const (
+	// The sender asks the recipient to persist the value, and return it in
+	// future SETTINGS frames.
+	FlagSettingsPersistValue uint8 = 0x01
+	// The value is one the sender was asked to persist.
+	FlagSettingsPersisted uint8 = 0x02
+)
+
+// Get returns the setting with the given id, if the frame holds one.
+func (s *Settings) Get(id SettingsId) (*Setting, bool) {
+	for _, setting := range s.Settings {
+		if setting.Id == id {
+			return setting, true
+		}
+	}
+	return nil, false
+}
+
+// Value returns the value of the setting with the given id, if the frame holds
+// one.
+func (s *Settings) Value(id SettingsId) (int32, bool) {
+	if setting, ok := s.Get(id); ok {
+		return setting.Value, true
+	}
+	return 0, false
+}
+
+// Set adds a setting to the frame, replacing any existing setting with the
+// same id.
+func (s *Settings) Set(id SettingsId, value int32, flags uint8) {
+	if setting, ok := s.Get(id); ok {
+		setting.Value = value
+		setting.Flags = flags
+		return
+	}
+	s.Settings = append(s.Settings, &Setting{
+		Flags: flags,
+		Id:    id,
+		Value: value,
+	})
+}
+
+// Del removes the setting with the given id from the frame.
+func (s *Settings) Del(id SettingsId) {
+	settings := s.Settings[:0]
+	for _, setting := range s.Settings {
+		if setting.Id != id {
+			settings = append(settings, setting)
+		}
+	}
+	s.Settings = settings
+}
+
 type settingv3 struct {
-	FlagId FlagLenWord
+	FlagId FlagIdWord
 	Value  int32
 }
 
+// SPDY/2 sent the id of a setting as 24 bits in little endian order, followed
+// by the flags.
+type settingv2 struct {
+	Id    [3]byte
+	Flags uint8
+	Value int32
+}
+
 func (s Settings) Type() FrameType {
 	return SettingsType
 }
@@ -470,6 +904,9 @@ func (s *Settings) Read(r io.Reader) (n int, err error) {
 	}
 	n += 4
 
+	if err = checkSettingsCount(r, numSettings); err != nil {
+		return
+	}
 	s.Settings = make([]*Setting, numSettings)
 	for i := uint32(0); i < numSettings; i++ {
 		setting := new(settingv3)
@@ -479,16 +916,130 @@ func (s *Settings) Read(r io.Reader) (n int, err error) {
 		n += 8
 		s.Settings[i] = &Setting{
 			Flags: setting.FlagId.Flags(),
-			Id:    setting.FlagId.Length(),
+			Id:    setting.FlagId.Id(),
 			Value: setting.Value,
 		}
 	}
 	return
 }
 
+// checkSettingsCount makes sure the body left in r can hold count settings of 8
+// bytes each, before room is made for them.
+func checkSettingsCount(r io.Reader, count uint32) error {
+	if !fits(r, uint64(count)*8) {
+		return sessionError(GoAwayProtocolError,
+			"SETTINGS frame too short for %d settings", count)
+	}
+	return nil
+}
+
+func (s *Settings) Write(w io.Writer) (n int, err error) {
+	if err = binary.Write(w, binary.BigEndian, uint32(len(s.Settings))); err != nil {
+		return
+	}
+	n += 4
+
+	for _, setting := range s.Settings {
+		frame := &settingv3{
+			FlagId: NewFlagIdWord(setting.Flags, setting.Id),
+			Value:  setting.Value,
+		}
+		if err = binary.Write(w, binary.BigEndian, frame); err != nil {
+			return
+		}
+		n += 8
+	}
+	return
+}
+
+func (s *Settings) readV2(r io.Reader) (n int, err error) {
+	var numSettings uint32
+	if err = binary.Read(r, binary.BigEndian, &numSettings); err != nil {
+		return
+	}
+	n += 4
+
+	if err = checkSettingsCount(r, numSettings); err != nil {
+		return
+	}
+	s.Settings = make([]*Setting, numSettings)
+	for i := uint32(0); i < numSettings; i++ {
+		setting := new(settingv2)
+		if err = binary.Read(r, binary.BigEndian, setting); err != nil {
+			return
+		}
+		n += 8
+		s.Settings[i] = &Setting{
+			Flags: setting.Flags,
+			Id: SettingsId(uint32(setting.Id[0]) | uint32(setting.Id[1])<<8 |
+				uint32(setting.Id[2])<<16),
+			Value: setting.Value,
+		}
+	}
+	return
+}
+
+func (s *Settings) writeV2(w io.Writer) (n int, err error) {
+	if err = binary.Write(w, binary.BigEndian, uint32(len(s.Settings))); err != nil {
+		return
+	}
+	n += 4
+
+	for _, setting := range s.Settings {
+		id := uint32(setting.Id)
+		frame := &settingv2{
+			Id:    [3]byte{byte(id), byte(id >> 8), byte(id >> 16)},
+			Flags: setting.Flags,
+			Value: setting.Value,
+		}
+		if err = binary.Write(w, binary.BigEndian, frame); err != nil {
+			return
+		}
+		n += 8
+	}
+	return
+}
+
+func (s *Settings) flags() uint8 {
+	return s.Flags
+}
+
 // Ensure Settings is a frame
 var _ Frame = &Settings{}
 
+// ----------------------------------------------------------------------------
+// NOOP
+//
+// SPDY/2 only. The NOOP control frame carries nothing, and is ignored.
+//
+//  +----------------------------------+
+//  |1|       2          |       5     |
+//  +----------------------------------+
+//  | 0 (Flags)  |    0 (Length)       |
+//  +----------------------------------+
+type Noop struct {
+	Flags uint8
+}
+
+func (n Noop) Type() FrameType {
+	return NoopType
+}
+
+func (n *Noop) Read(r io.Reader) (int, error) {
+	return 0, nil
+}
+
+func (n *Noop) Write(w io.Writer) (int, error) {
+	return 0, nil
+}
+
+func (n *Noop) flags() uint8 {
+	return n.Flags
+}
+
+// Ensure Noop is a frame
+var _ Frame = &Noop{}
+
 // ----------------------------------------------------------------------------
 // PING
 //
@@ -507,7 +1058,8 @@ var _ Frame = &Settings{}
 //  +----------------------------------+
 
 type Ping struct {
-	Id uint32
+	Flags uint8
+	Id    uint32
 }
 
 func (p Ping) Type() FrameType {
@@ -515,13 +1067,25 @@ func (p Ping) Type() FrameType {
 }
 
 func (p *Ping) Read(r io.Reader) (n int, err error) {
-	if err = binary.Read(r, binary.BigEndian, p); err != nil {
+	if err = binary.Read(r, binary.BigEndian, &p.Id); err != nil {
 		return
 	}
 	n += 4
 	return
 }
 
+func (p *Ping) Write(w io.Writer) (n int, err error) {
+	if err = binary.Write(w, binary.BigEndian, p.Id); err != nil {
+		return
+	}
+	n += 4
+	return
+}
+
+func (p *Ping) flags() uint8 {
+	return p.Flags
+}
+
 // Ensure Ping is a frame
 var _ Frame = &Ping{}
 
@@ -548,13 +1112,19 @@ var _ Frame = &Ping{}
 //  +----------------------------------+
 
 type GoAway struct {
+	Flags            uint8
 	LastGoodStreamId uint32
-	StatusCode       uint32
+	StatusCode       GoAwayStatus
 }
 
 type goAwayFramev3 struct {
 	LastGoodStreamId StreamIdWord
-	StatusCode       uint32
+	StatusCode       GoAwayStatus
+}
+
+// SPDY/2 has no status code.
+type goAwayFramev2 struct {
+	LastGoodStreamId StreamIdWord
 }
 
 func (g GoAway) Type() FrameType {
@@ -573,6 +1143,45 @@ func (g *GoAway) Read(r io.Reader) (n int, err error) {
 	return
 }
 
+func (g *GoAway) Write(w io.Writer) (n int, err error) {
+	frame := &goAwayFramev3{
+		LastGoodStreamId: StreamIdWord(g.LastGoodStreamId & 0x7FFFFFFF),
+		StatusCode:       g.StatusCode,
+	}
+	if err = binary.Write(w, binary.BigEndian, frame); err != nil {
+		return
+	}
+	n += binary.Size(frame)
+	return
+}
+
+func (g *GoAway) readV2(r io.Reader) (n int, err error) {
+	frame := new(goAwayFramev2)
+	if err = binary.Read(r, binary.BigEndian, frame); err != nil {
+		return
+	}
+	n += binary.Size(frame)
+
+	g.LastGoodStreamId = frame.LastGoodStreamId.StreamId()
+	g.StatusCode = GoAwayOK
+	return
+}
+
+func (g *GoAway) writeV2(w io.Writer) (n int, err error) {
+	frame := &goAwayFramev2{
+		LastGoodStreamId: StreamIdWord(g.LastGoodStreamId & 0x7FFFFFFF),
+	}
+	if err = binary.Write(w, binary.BigEndian, frame); err != nil {
+		return
+	}
+	n += binary.Size(frame)
+	return
+}
+
+func (g *GoAway) flags() uint8 {
+	return g.Flags
+}
+
 // Ensure GoAway is a frame
 var _ Frame = &GoAway{}
 
@@ -603,7 +1212,9 @@ var _ Frame = &GoAway{}
 //  +------------------------------------+    |
 //  |           (repeats)                |   <+
 type Headers struct {
+	Flags             uint8
 	StreamId          uint32
+	Headers           NameValuePairs
 	CompressedHeaders CompressedNameValuePairs
 }
 
@@ -611,6 +1222,12 @@ type headersFramev3 struct {
 	StreamId StreamIdWord
 }
 
+// SPDY/2 puts 16 unused bits ahead of the header block.
+type headersFramev2 struct {
+	StreamId StreamIdWord
+	Unused   uint16
+}
+
 func (h Headers) Type() FrameType {
 	return HeadersType
 }
@@ -627,6 +1244,59 @@ func (h *Headers) Read(r io.Reader) (n int, err error) {
 	return
 }
 
+func (h *Headers) Write(w io.Writer) (n int, err error) {
+	frame := &headersFramev3{
+		StreamId: StreamIdWord(h.StreamId & 0x7FFFFFFF),
+	}
+	if err = binary.Write(w, binary.BigEndian, frame); err != nil {
+		return
+	}
+	n += binary.Size(frame)
+
+	i, err := w.Write(h.CompressedHeaders)
+	n += i
+	return
+}
+
+func (h *Headers) readV2(r io.Reader) (n int, err error) {
+	frame := new(headersFramev2)
+	if err = binary.Read(r, binary.BigEndian, frame); err != nil {
+		return
+	}
+	n += binary.Size(frame)
+
+	h.StreamId = frame.StreamId.StreamId()
+	h.CompressedHeaders, err = ioutil.ReadAll(r)
+	n += len(h.CompressedHeaders)
+	return
+}
+
+func (h *Headers) writeV2(w io.Writer) (n int, err error) {
+	frame := &headersFramev2{
+		StreamId: StreamIdWord(h.StreamId & 0x7FFFFFFF),
+	}
+	if err = binary.Write(w, binary.BigEndian, frame); err != nil {
+		return
+	}
+	n += binary.Size(frame)
+
+	i, err := w.Write(h.CompressedHeaders)
+	n += i
+	return
+}
+
+func (h *Headers) flags() uint8 {
+	return h.Flags
+}
+
+func (h *Headers) streamId() uint32 {
+	return h.StreamId
+}
+
+func (h *Headers) headerBlock() (*NameValuePairs, *CompressedNameValuePairs) {
+	return &h.Headers, &h.CompressedHeaders
+}
+
 // Ensure Headers is a frame
 var _ Frame = &Headers{}
 
@@ -655,6 +1325,7 @@ var _ Frame = &Headers{}
 //  |X|  Delta-Window-Size (31-bits)   |
 //  +----------------------------------+
 type WindowUpdate struct {
+	Flags           uint8
 	StreamId        uint32
 	DeltaWindowSize uint32
 }
@@ -680,12 +1351,236 @@ func (w *WindowUpdate) Read(r io.Reader) (n int, err error) {
 	return
 }
 
+func (w *WindowUpdate) Write(wr io.Writer) (n int, err error) {
+	frame := &windowUpdateFramev3{
+		StreamId:        StreamIdWord(w.StreamId & 0x7FFFFFFF),
+		DeltaWindowSize: StreamIdWord(w.DeltaWindowSize & 0x7FFFFFFF),
+	}
+	if err = binary.Write(wr, binary.BigEndian, frame); err != nil {
+		return
+	}
+	n += binary.Size(frame)
+	return
+}
+
+func (w *WindowUpdate) flags() uint8 {
+	return w.Flags
+}
+
 // Ensure Headers is a frame
 var _ Frame = &WindowUpdate{}
 
+// ----------------------------------------------------------------------------
+// CREDENTIAL
+//
+// The CREDENTIAL control frame is used by the client to send additional client
+// certificates to the server. A SPDY client may decide to send requests for
+// resources from different origins on the same SPDY session if it decides that
+// that server handles both origins.
+//
+//  +----------------------------------+
+//  |1|000000000000011|0000000000001010|
+//  +----------------------------------+
+//  | flags (8)  |  Length (24 bits)   |
+//  +----------------------------------+
+//  |  Slot (16 bits) |                |
+//  +-----------------+                |
+//  |      Proof Length (32 bits)      |
+//  +----------------------------------+
+//  |               Proof              |
+//  +----------------------------------+ <+
+//  |   Certificate Length (32 bits)   |  |
+//  +----------------------------------+  | Repeated until end of frame
+//  |            Certificate           |  |
+//  +----------------------------------+ <+
+type Credential struct {
+	Flags        uint8
+	Slot         uint16
+	Proof        []byte
+	Certificates [][]byte
+}
+
+func (c Credential) Type() FrameType {
+	return CredentialType
+}
+
+func (c *Credential) Read(r io.Reader) (n int, err error) {
+	if err = binary.Read(r, binary.BigEndian, &c.Slot); err != nil {
+		return
+	}
+	n += 2
+
+	var i int
+	if c.Proof, i, err = readBytes(r); err != nil {
+		return
+	}
+	n += i
+
+	c.Certificates = nil
+	for {
+		var cert []byte
+		cert, i, err = readBytes(r)
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return
+		}
+		n += i
+		c.Certificates = append(c.Certificates, cert)
+	}
+}
+
+func (c *Credential) Write(w io.Writer) (n int, err error) {
+	if err = binary.Write(w, binary.BigEndian, c.Slot); err != nil {
+		return
+	}
+	n += 2
+
+	var i int
+	if i, err = writeBytes(w, c.Proof); err != nil {
+		return
+	}
+	n += i
+
+	for _, cert := range c.Certificates {
+		if i, err = writeBytes(w, cert); err != nil {
+			return
+		}
+		n += i
+	}
+	return
+}
+
+func (c *Credential) flags() uint8 {
+	return c.Flags
+}
+
+// Ensure Credential is a frame
+var _ Frame = &Credential{}
+
+// ----------------------------------------------------------------------------
+// DATA
+//
+// Data frames carry the payload of a stream. They share the first two words
+// with control frames, the control bit is always 0 and the stream id takes the
+// place of the version and type.
+//
+//  +----------------------------------+
+//  |C|       Stream-ID (31bits)       |
+//  +----------------------------------+
+//  | Flags (8)  |  Length (24 bits)   |
+//  +----------------------------------+
+//  |               Data               |
+//  +----------------------------------+
+type DataFrame struct {
+	Flags    uint8
+	StreamId uint32
+	Data     []byte
+}
+
+func (d DataFrame) Type() FrameType {
+	return DataFrameType
+}
+
+func (d *DataFrame) Read(r io.Reader) (n int, err error) {
+	d.Data, err = ioutil.ReadAll(r)
+	n += len(d.Data)
+	return
+}
+
+func (d *DataFrame) Write(w io.Writer) (int, error) {
+	return w.Write(d.Data)
+}
+
+func (d *DataFrame) flags() uint8 {
+	return d.Flags
+}
+
+// Ensure DataFrame is a frame
+var _ Frame = &DataFrame{}
+
 // ----------------------------------------------------------------------------
 // Helper functions
 
+// readBytes reads a 32-bit length followed by that many bytes. io.EOF is only
+// returned if there was nothing at all left to read, and io.ErrUnexpectedEOF
+// before making room for more bytes than r can hold.
+func readBytes(r io.Reader) (bs []byte, n int, err error) {
+	var length uint32
+	if err = binary.Read(r, binary.BigEndian, &length); err != nil {
+		return
+	}
+	n += 4
+
+	if !fits(r, uint64(length)) {
+		return nil, n, io.ErrUnexpectedEOF
+	}
+	bs = make([]byte, length)
+	if _, err = io.ReadFull(r, bs); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	n += int(length)
+	return
+}
+
+// fits is false if r cannot hold size more bytes: either it knows how many it
+// has left, as the body of a frame read by a Framer does, or size is more than
+// any frame can carry.
+func fits(r io.Reader, size uint64) bool {
+	if size > MaxFrameLength {
+		return false
+	}
+	if l, ok := r.(interface{ Len() int }); ok {
+		return uint64(l.Len()) >= size
+	}
+	return true
+}
+
+// readLength reads a count or length within a header block, which is 16 bits in
+// SPDY/2 and 32 bits after.
+func readLength(r io.Reader, version SpdyVersion) (length uint32, n int, err error) {
+	if version == Spdy2 {
+		var short uint16
+		err = binary.Read(r, binary.BigEndian, &short)
+		return uint32(short), 2, err
+	}
+	err = binary.Read(r, binary.BigEndian, &length)
+	return length, 4, err
+}
+
+// writeLength writes a count or length within a header block.
+func writeLength(w io.Writer, version SpdyVersion, length int) (int, error) {
+	if version == Spdy2 {
+		if length > 0xFFFF {
+			return 0, fmt.Errorf("Header block length %d too large for SPDY/2", length)
+		}
+		return writeHalfWord(w, uint16(length))
+	}
+	return writeWord(w, uint32(length))
+}
+
+// writeBytes writes a 32-bit length followed by the bytes themselves.
+func writeBytes(w io.Writer, bs []byte) (n int, err error) {
+	if err = binary.Write(w, binary.BigEndian, uint32(len(bs))); err != nil {
+		return
+	}
+	n += 4
+
+	i, err := w.Write(bs)
+	n += i
+	return
+}
+
+func writeHalfWord(w io.Writer, word uint16) (int, error) {
+	return w.Write([]byte{
+		byte(word & 0xff00 >> 8),
+		byte(word & 0x00ff),
+	})
+}
+
 func writeWord(w io.Writer, word uint32) (int, error) {
 	return w.Write([]byte{
 		byte(word & 0xff000000 >> 24),
@@ -2,6 +2,7 @@ package spdy3
 
 import (
 	"bytes"
+	"io"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -18,378 +19,550 @@ var _ = Describe("Header Word", func() {
 			buf = new(bytes.Buffer)
 		})
 
-		Describe("should be a control frame", func() {
+		It("should be a control frame", func() {
 			Expect(header.Control()).To(BeTrue())
 		})
 
-		Describe("should know its version", func() {
+		It("should know its version", func() {
 			Expect(header.Version()).To(Equal(Spdy3))
 		})
 
-		Describe("should know its type", func() {
+		It("should know its type", func() {
 			Expect(header.Type()).To(Equal(SynReplyType))
 		})
 
-		Describe("should set its fields", func() {
+		It("should know all 15 bits of its version", func() {
+			Expect(HeaderWord(0x80830002).Version()).To(Equal(SpdyVersion(0x83)))
+			Expect(HeaderWord(0xFFFF0002).Version()).To(Equal(SpdyVersion(0x7FFF)))
+			Expect(NewHeaderWord(true, 0x7FFF, PingType).Version()).To(Equal(SpdyVersion(0x7FFF)))
+		})
+
+		It("should set its fields", func() {
 			header := NewHeaderWord(true, Spdy3, PingType)
 			Expect(header.Control()).To(BeTrue())
-			// Expect(header.Version()).To(Equal(uint16(3))) // TODO don't cast
+			Expect(header.Version()).To(Equal(Spdy3))
 			Expect(header.Type()).To(Equal(PingType))
 		})
 
-		// c.It("should write its control bit", func(c *spec.C) {
-		// 	header := NewHeaderWord(true, Spdy3, SynReplyType)
-		// 	n, err := header.Write(buf)
-		// 	c.Assert(err).IsNil()
-		// 	c.Assert(n).Equals(4)
-
-		// 	bs := buf.Bytes()
-		// 	c.Assert(bs[0]).Equals(byte(0x80))
-
-		// 	buf.Reset()
-		// 	NewHeaderWord(false, Spdy3, SynReplyType).Write(buf)
-		// 	bs = buf.Bytes()
-		// 	c.Assert(bs[0]).Equals(byte(0x00))
-		// })
-
-		// c.It("should write its version and type", func(c *spec.C) {
-		// 	NewHeaderWord(true, Spdy3, SynReplyType).Write(buf)
-		// 	bs := buf.Bytes()
-
-		// 	c.Assert(bs).HasLen(4)
-		// 	c.Assert(bs[0]).Equals(byte(0x80))
-		// 	c.Assert(bs[1]).Equals(byte(0x03))
-		// 	c.Assert(bs[2]).Equals(byte(0x00))
-		// 	c.Assert(bs[3]).Equals(byte(0x02))
-		// })
-	})
-	//
-	// 	c.It("when a data frame", func(c *spec.C) {
-	// 		var header HeaderWord = 0x000A2C2A
-	// 		c.It("should not be a control frame", func(c *spec.C) {
-	// 			c.Assert(header.Control()).IsFalse()
-	// 		})
-	// 	})
-	//
-	// 	c.It("should err with UNSUPPORTED_VERSION", func(c *spec.C) {
-	// 		c.Skip("pending")
-	// 	})
-	// })
-	//
-	// var _ = spec.Suite("Flag/Len Word", func(c *spec.C) {
-	// 	var word FlagLenWord = 0xAB123456
-	//
-	// 	c.It("should know its flags", func(c *spec.C) {
-	// 		c.Assert(word.Flags()).Equals(uint8(171))
-	// 	})
-	//
-	// 	c.It("should know its length", func(c *spec.C) {
-	// 		c.Assert(word.Length()).Equals(uint32(1193046))
-	// 	})
-	//
-	// 	c.It("must return a protocol err if len > 2^24", func(c *spec.C) {
-	// 		c.Skip("pending")
-	// 	})
-	// })
-	//
-	// var _ = spec.Suite("StreamId Word", func(c *spec.C) {
-	// 	var word StreamIdWord = 0xFFFFFFFF
-	//
-	// 	c.It("should know its stream ID", func(c *spec.C) {
-	// 		// Won't actually be 4294967295 -- first bit is dropped
-	// 		c.Assert(word.StreamId()).Equals(uint32(2147483647))
-	// 	})
-	//
-	// 	c.It("Should read from an io.Reader", func(c *spec.C) {
-	// 		var streamIdWord StreamIdWord
-	// 		r := bytes.NewBuffer([]byte{0x00, 0x00, 0x02, 0x9A})
-	// 		n, err := streamIdWord.Read(r)
-	// 		c.Assert(n).Equals(4)
-	// 		c.Assert(err).IsNil()
-	// 		c.Assert(streamIdWord.StreamId()).Equals(uint32(666))
-	// 	})
-	// })
-	//
-	// var _ = spec.Suite("Priority Word", func(c *spec.C) {
-	// 	c.It("Should know its priority", func(c *spec.C) {
-	// 		var p PriorityWord = 0x20000000
-	// 		c.Assert(p.Priority()).Equals(uint8(1))
-	//
-	// 		p = 0xA0000000
-	// 		c.Assert(p.Priority()).Equals(uint8(5))
-	//
-	// 		p = 0xE0000000
-	// 		c.Assert(p.Priority()).Equals(uint8(7))
-	//
-	// 		p = 0xFFFFFFFF
-	// 		c.Assert(p.Priority()).Equals(uint8(7))
-	// 	})
-	// })
-	//
-	// var pairs = []byte{
-	// 	0x00, 0x00, 0x00, 0x02, // | Number of Name/Value pairs (int32) |
-	// 	0x00, 0x00, 0x00, 0x04, // |     Length of name (int32)         |
-	// 	0x6e, 0x61, 0x6d, 0x65, // |           Name (string)            |
-	// 	0x00, 0x00, 0x00, 0x05, // |     Length of value  (int32)       |
-	// 	0x4d, 0x61, 0x72, 0x6b, // |          Value   (string)          |
-	// 	0x21,
-	// 	0x00, 0x00, 0x00, 0x04, // |     Length of name (int32)         |
-	// 	0x6a, 0x6f, 0x62, 0x3f, // |           Name (string)            |
-	// 	0x00, 0x00, 0x00, 0x09, // |     Length of value  (int32)       |
-	// 	0x6f, 0x68, 0x2c, 0x20, // |          Value   (string)          |
-	// 	0x72, 0x69, 0x67, 0x68,
-	// 	0x74,
-	// }
-	//
-	// var _ = spec.Suite("Name/Value pairs", func(c *spec.C) {
-	// 	c.It("should read a basic set of pairs", func(c *spec.C) {
-	// 		r := bytes.NewBuffer(pairs)
-	// 		nameValuePairs := make(NameValuePairs)
-	// 		n, err := nameValuePairs.Read(r)
-	//
-	// 		c.Assert(n).Equals(42)
-	// 		c.Assert(err).IsNil()
-	//
-	// 		c.Assert(nameValuePairs).HasLen(2)
-	// 		name, ok := nameValuePairs["name"]
-	// 		c.Assert(ok).IsTrue()
-	// 		c.Assert(name).Equals("Mark!")
-	//
-	// 		job, ok := nameValuePairs["job?"]
-	// 		c.Assert(ok).IsTrue()
-	// 		c.Assert(job).Equals("oh, right")
-	// 	})
-	//
-	// 	c.It("should write uncompressed", func(c *spec.C) {
-	// 		nvp := make(NameValuePairs)
-	//
-	// 		// Set up exactly like above, may be re-ordered, however.
-	// 		nvp["name"] = "Mark!"
-	// 		nvp["job?"] = "oh, right"
-	//
-	// 		buf := new(bytes.Buffer)
-	// 		n, err := nvp.Write(buf)
-	// 		c.Assert(err).IsNil()
-	// 		c.Assert(n).Equals(42)
-	// 	})
-	//
-	// 	c.It("must reject a zero-length name with a stream error", func(c *spec.C) {
-	// 		c.Skip("pending")
-	// 	})
-	//
-	// 	c.It("must reject duplicate header names", func(c *spec.C) {
-	// 		c.Skip("pending")
-	// 	})
-	//
-	// 	c.It("should accept mutliple header values", func(c *spec.C) {
-	// 		c.Skip("pending")
-	// 	})
-	// })
-	//
-	// var _ = spec.Suite("SYN_STREAM", func(c *spec.C) {
-	// 	var synStreamBody = []byte{
-	// 		0x00, 0x00, 0x02, 0x9A, // |X|           Stream-ID (31bits)     |
-	// 		0x49, 0x96, 0x02, 0xD2, // |X| Associated-To-Stream-ID (31bits) |
-	// 		0xA0, 0x00, 0x00, 0x00, // | Pri|Unused | Slot |                |
-	// 		0x00, 0x01, 0x02, 0x03, // | Raw headers...                     |
-	// 	}
-	// 	var r = bytes.NewBuffer(synStreamBody)
-	//
-	// 	synStream := new(SynStream)
-	// 	_, err := synStream.Read(r)
-	// 	c.Assert(err).IsNil()
-	//
-	// 	c.It("should be type 1", func(c *spec.C) {
-	// 		c.Assert(SynStreamType).Equals(FrameType(1))
-	// 	})
-	//
-	// 	c.It("should parse its stream ids", func(c *spec.C) {
-	// 		c.Assert(synStream.StreamId).Equals(uint32(666))
-	// 		c.Assert(synStream.AssociatedStreamId).Equals(uint32(1234567890))
-	// 	})
-	//
-	// 	c.It("should parse its priority", func(c *spec.C) {
-	// 		c.Assert(synStream.Priority).Equals(uint8(5))
-	// 	})
-	//
-	// 	c.It("should parse its raw headers", func(c *spec.C) {
-	// 		c.Assert(synStream.CompressedHeaders).HasLen(4)
-	// 		c.Assert(synStream.CompressedHeaders[0]).Equals(byte(0x00))
-	// 		c.Assert(synStream.CompressedHeaders[1]).Equals(byte(0x01))
-	// 		c.Assert(synStream.CompressedHeaders[2]).Equals(byte(0x02))
-	// 		c.Assert(synStream.CompressedHeaders[3]).Equals(byte(0x03))
-	// 	})
-	// })
-	//
-	// var _ = spec.Suite("SYN_REPLY", func(c *spec.C) {
-	// 	var synReplyBody = []byte{
-	// 		0x00, 0x00, 0x02, 0x9A, // |X|           Stream-ID (31bits)     |
-	// 		0x00, 0x01, 0x02, 0x03, // | Raw headers...                     |
-	// 	}
-	// 	var r = bytes.NewBuffer(synReplyBody)
-	// 	synReply := new(SynReply)
-	// 	_, err := synReply.Read(r)
-	// 	c.Assert(err).IsNil()
-	//
-	// 	c.It("should be type 2", func(c *spec.C) {
-	// 		c.Assert(SynReplyType).Equals(FrameType(2))
-	// 	})
-	//
-	// 	c.It("should parse its stream id", func(c *spec.C) {
-	// 		c.Assert(synReply.StreamId).Equals(uint32(666))
-	// 	})
-	//
-	// 	c.It("should parse its raw headers", func(c *spec.C) {
-	// 		c.Assert(synReply.CompressedHeaders).HasLen(4)
-	// 		c.Assert(synReply.CompressedHeaders[0]).Equals(byte(0x00))
-	// 		c.Assert(synReply.CompressedHeaders[1]).Equals(byte(0x01))
-	// 		c.Assert(synReply.CompressedHeaders[2]).Equals(byte(0x02))
-	// 		c.Assert(synReply.CompressedHeaders[3]).Equals(byte(0x03))
-	// 	})
-	// })
-	//
-	// var _ = spec.Suite("RST_STREAM", func(c *spec.C) {
-	// 	var rstStreamBody = []byte{
-	// 		0x00, 0x00, 0x02, 0x9B, // |X|          Stream-ID (31bits)    |
-	// 		0x00, 0x00, 0x00, 0x32, // |          Status code             |
-	// 	}
-	//
-	// 	var r = bytes.NewBuffer(rstStreamBody)
-	// 	rstStream := new(RstStream)
-	// 	_, err := rstStream.Read(r)
-	// 	c.Assert(err).IsNil()
-	//
-	// 	c.It("should be type 3", func(c *spec.C) {
-	// 		c.Assert(RstStreamType).Equals(FrameType(3))
-	// 	})
-	//
-	// 	c.It("should read its stream id", func(c *spec.C) {
-	// 		c.Assert(rstStream.StreamId).Equals(uint32(667))
-	// 	})
-	//
-	// 	c.It("should read its status code", func(c *spec.C) {
-	// 		c.Assert(rstStream.StatusCode).Equals(int32(50))
-	// 	})
-	// })
-	//
-	// var _ = spec.Suite("SETTINGS", func(c *spec.C) {
-	// 	c.It("should be type 4", func(c *spec.C) {
-	// 		c.Assert(SettingsType).Equals(FrameType(4))
-	// 	})
-	//
-	// 	c.It("should read an empty settings frame", func(c *spec.C) {
-	// 		r := bytes.NewBuffer([]byte{
-	// 			0x00, 0x00, 0x00, 0x00, // |         Number of entries        |
-	// 		})
-	// 		settings := new(Settings)
-	// 		_, err := settings.Read(r)
-	// 		c.Assert(err).IsNil()
-	// 		c.Assert(settings.Settings).HasLen(0)
-	// 	})
-	//
-	// 	c.It("should read a populated settings frame", func(c *spec.C) {
-	// 		r := bytes.NewBuffer([]byte{
-	// 			0x00, 0x00, 0x00, 0x01, // |         Number of entries        |
-	// 			0x01, 0x00, 0x00, 0x23, // | Flags(8) |      ID (24 bits)     |
-	// 			0x00, 0x00, 0x02, 0x9C, // |          Value (32 bits)         |
-	// 		})
-	// 		settings := new(Settings)
-	// 		_, err := settings.Read(r)
-	// 		c.Assert(err).IsNil()
-	// 		c.Assert(settings.Settings).HasLen(1)
-	// 		s0 := settings.Settings[0]
-	// 		c.Assert(s0.Flags).Equals(uint8(1))
-	// 		c.Assert(s0.Id).Equals(uint32(35))
-	// 		c.Assert(s0.Value).Equals(int32(668))
-	// 	})
-	// })
-	//
-	// var _ = spec.Suite("PING", func(c *spec.C) {
-	// 	c.It("should be type 6", func(c *spec.C) {
-	// 		c.Assert(PingType).Equals(FrameType(6))
-	// 	})
-	//
-	// 	c.It("should read", func(c *spec.C) {
-	// 		r := bytes.NewBuffer([]byte{
-	// 			0x00, 0x00, 0x66, 0x12, // |            32-bit ID             |
-	// 		})
-	// 		ping := new(Ping)
-	// 		_, err := ping.Read(r)
-	// 		c.Assert(err).IsNil()
-	// 		c.Assert(ping.Id).Equals(uint32(26130))
-	// 	})
-	// })
-	//
-	// var _ = spec.Suite("GOAWAY", func(c *spec.C) {
-	// 	c.It("should be type 7", func(c *spec.C) {
-	// 		c.Assert(GoAwayType).Equals(FrameType(7))
-	// 	})
-	//
-	// 	c.It("should read", func(c *spec.C) {
-	// 		r := bytes.NewBuffer([]byte{
-	// 			0x00, 0x00, 0x02, 0x9A, // |X|  Last-good-stream-ID (31 bits) |
-	// 			0x00, 0x00, 0x24, 0x68, // |          Status code             |
-	// 		})
-	// 		goaway := new(GoAway)
-	// 		_, err := goaway.Read(r)
-	// 		c.Assert(err).IsNil()
-	// 		c.Assert(goaway.LastGoodStreamId).Equals(uint32(666))
-	// 		c.Assert(goaway.StatusCode).Equals(uint32(9320))
-	// 	})
-	// })
-	//
-	// var _ = spec.Suite("HEADERS", func(c *spec.C) {
-	// 	c.It("should be type 8", func(c *spec.C) {
-	// 		c.Assert(HeadersType).Equals(FrameType(8))
-	// 	})
-	//
-	// 	c.It("should read", func(c *spec.C) {
-	// 		var r = bytes.NewBuffer([]byte{
-	// 			0x00, 0x00, 0x02, 0x9A, // |X|           Stream-ID (31bits)     |
-	// 			0x03, 0x02, 0x01, 0x00, // | Raw headers...                     |
-	// 		})
-	//
-	// 		headers := new(Headers)
-	// 		_, err := headers.Read(r)
-	// 		c.Assert(err).IsNil()
-	//
-	// 		c.Assert(headers.StreamId).Equals(uint32(666))
-	// 		c.Assert(headers.CompressedHeaders).HasLen(4)
-	// 		h := headers.CompressedHeaders
-	// 		c.Assert(h[0]).Equals(byte(0x03))
-	// 		c.Assert(h[1]).Equals(byte(0x02))
-	// 		c.Assert(h[2]).Equals(byte(0x01))
-	// 		c.Assert(h[3]).Equals(byte(0x00))
-	// 	})
-	// })
-	//
-	// var _ = spec.Suite("WINDOW_UPDATE", func(c *spec.C) {
-	// 	c.It("should be type 9", func(c *spec.C) {
-	// 		c.Assert(WindowUpdateType).Equals(FrameType(9))
-	// 	})
-	//
-	// 	c.It("should allow a negative delta window size?", func(c *spec.C) {
-	// 		c.Skip("unsure")
-	// 	})
-	//
-	// 	c.It("should read", func(c *spec.C) {
-	// 		var r = bytes.NewBuffer([]byte{
-	// 			0x00, 0x00, 0x02, 0x99, // |X|     Stream-ID (31-bits)        |
-	// 			0x00, 0x00, 0x00, 0x99, // |X|  Delta-Window-Size (31-bits)   |
-	// 		})
-	// 		windowUpdate := new(WindowUpdate)
-	// 		_, err := windowUpdate.Read(r)
-	// 		c.Assert(err).IsNil()
-	//
-	// 		c.Assert(windowUpdate.StreamId).Equals(uint32(665))
-	// 		c.Assert(windowUpdate.DeltaWindowSize).Equals(uint32(153))
-	// 	})
-	// })
-	//
-	// var _ = spec.Suite("CREDENTIAL", func(c *spec.C) {
-	// 	c.Skip("impl pending")
-	//
-	// 	c.It("should be type 10", func(c *spec.C) {
-	// 		c.Assert(CredentialType).Equals(FrameType(10))
-	// 	})
+		It("should write its control bit", func() {
+			header := NewHeaderWord(true, Spdy3, SynReplyType)
+			n, err := header.Write(buf)
+			Expect(err).To(BeNil())
+			Expect(n).To(Equal(4))
+
+			bs := buf.Bytes()
+			Expect(bs[0]).To(Equal(byte(0x80)))
+
+			buf.Reset()
+			NewHeaderWord(false, Spdy3, SynReplyType).Write(buf)
+			bs = buf.Bytes()
+			Expect(bs[0]).To(Equal(byte(0x00)))
+		})
+
+		It("should write its version and type", func() {
+			NewHeaderWord(true, Spdy3, SynReplyType).Write(buf)
+			bs := buf.Bytes()
+
+			Expect(bs).To(HaveLen(4))
+			Expect(bs[0]).To(Equal(byte(0x80)))
+			Expect(bs[1]).To(Equal(byte(0x03)))
+			Expect(bs[2]).To(Equal(byte(0x00)))
+			Expect(bs[3]).To(Equal(byte(0x02)))
+		})
+	})
+
+	Describe("Data frame", func() {
+		var header HeaderWord = 0x000A2C2A
+
+		It("should not be a control frame", func() {
+			Expect(header.Control()).To(BeFalse())
+		})
+	})
+})
+
+var _ = Describe("Flag/Len Word", func() {
+	var word FlagLenWord = 0xAB123456
+
+	It("should know its flags", func() {
+		Expect(word.Flags()).To(Equal(uint8(171)))
+	})
+
+	It("should know its length", func() {
+		Expect(word.Length()).To(Equal(uint32(1193046)))
+	})
+})
+
+var _ = Describe("StreamId Word", func() {
+	var word StreamIdWord = 0xFFFFFFFF
+
+	It("should know its stream ID", func() {
+		// Won't actually be 4294967295 -- first bit is dropped
+		Expect(word.StreamId()).To(Equal(uint32(2147483647)))
+	})
+
+	It("Should read from an io.Reader", func() {
+		var streamIdWord StreamIdWord
+		r := bytes.NewBuffer([]byte{0x00, 0x00, 0x02, 0x9A})
+		n, err := streamIdWord.Read(r)
+		Expect(n).To(Equal(4))
+		Expect(err).To(BeNil())
+		Expect(streamIdWord.StreamId()).To(Equal(uint32(666)))
+	})
+})
+
+var _ = Describe("Priority Word", func() {
+	It("Should know its priority", func() {
+		var p PriorityWord = 0x2000
+		Expect(p.Priority()).To(Equal(uint8(1)))
+
+		p = 0xA000
+		Expect(p.Priority()).To(Equal(uint8(5)))
+
+		p = 0xE000
+		Expect(p.Priority()).To(Equal(uint8(7)))
+
+		p = 0xFFFF
+		Expect(p.Priority()).To(Equal(uint8(7)))
+	})
+
+	It("Should read from an io.Reader", func() {
+		var p PriorityWord
+		n, err := p.Read(bytes.NewBuffer([]byte{0x60, 0x00}))
+		Expect(err).To(BeNil())
+		Expect(n).To(Equal(2))
+		Expect(p.Priority()).To(Equal(uint8(3)))
+	})
+})
+
+var pairs = []byte{
+	0x00, 0x00, 0x00, 0x02, // | Number of Name/Value pairs (int32) |
+	0x00, 0x00, 0x00, 0x04, // |     Length of name (int32)         |
+	0x6e, 0x61, 0x6d, 0x65, // |           Name (string)            |
+	0x00, 0x00, 0x00, 0x05, // |     Length of value  (int32)       |
+	0x4d, 0x61, 0x72, 0x6b, // |          Value   (string)          |
+	0x21,
+	0x00, 0x00, 0x00, 0x04, // |     Length of name (int32)         |
+	0x6a, 0x6f, 0x62, 0x3f, // |           Name (string)            |
+	0x00, 0x00, 0x00, 0x09, // |     Length of value  (int32)       |
+	0x6f, 0x68, 0x2c, 0x20, // |          Value   (string)          |
+	0x72, 0x69, 0x67, 0x68,
+	0x74,
+}
+
+var _ = Describe("Name/Value pairs", func() {
+	It("should read a basic set of pairs", func() {
+		r := bytes.NewBuffer(pairs)
+		nameValuePairs := make(NameValuePairs)
+		n, err := nameValuePairs.Read(r)
+
+		Expect(n).To(Equal(42))
+		Expect(err).To(BeNil())
+
+		Expect(nameValuePairs).To(HaveLen(2))
+		Expect(nameValuePairs).To(HaveKeyWithValue("name", []string{"Mark!"}))
+		Expect(nameValuePairs).To(HaveKeyWithValue("job?", []string{"oh, right"}))
+	})
+
+	It("should write uncompressed", func() {
+		nvp := make(NameValuePairs)
+
+		// Set up exactly like above, may be re-ordered, however.
+		nvp.Set("name", "Mark!")
+		nvp.Set("job?", "oh, right")
+
+		buf := new(bytes.Buffer)
+		n, err := nvp.Write(buf)
+		Expect(err).To(BeNil())
+		Expect(n).To(Equal(42))
+	})
+
+	It("should split NUL separated values", func() {
+		r := bytes.NewBuffer([]byte{
+			0x00, 0x00, 0x00, 0x01, // | Number of Name/Value pairs (int32) |
+			0x00, 0x00, 0x00, 0x01, // |     Length of name (int32)         |
+			0x61,                   // |           Name (string)            |
+			0x00, 0x00, 0x00, 0x05, // |     Length of value  (int32)       |
+			0x6f, 0x6e, 0x65, 0x00, // |          Value   (string)          |
+			0x32,
+		})
+		nvp := make(NameValuePairs)
+		_, err := nvp.Read(r)
+		Expect(err).To(BeNil())
+		Expect(nvp).To(Equal(NameValuePairs{"a": {"one", "2"}}))
+	})
+
+	It("should join multiple values with NULs", func() {
+		nvp := make(NameValuePairs)
+		nvp.Add("a", "one")
+		nvp.Add("a", "2")
+
+		buf := new(bytes.Buffer)
+		_, err := nvp.Write(buf)
+		Expect(err).To(BeNil())
+		Expect(buf.Bytes()).To(Equal([]byte{
+			0x00, 0x00, 0x00, 0x01, // | Number of Name/Value pairs (int32) |
+			0x00, 0x00, 0x00, 0x01, // |     Length of name (int32)         |
+			0x61,                   // |           Name (string)            |
+			0x00, 0x00, 0x00, 0x05, // |     Length of value  (int32)       |
+			0x6f, 0x6e, 0x65, 0x00, // |          Value   (string)          |
+			0x32,
+		}))
+	})
+
+	It("should round trip duplicate values", func() {
+		nvp := make(NameValuePairs)
+		nvp.Add("set-cookie", "a=1")
+		nvp.Add("Set-Cookie", "b=2")
+		nvp.Set("content-type", "text/plain")
+		Expect(nvp.Get("SET-COOKIE")).To(Equal("a=1"))
+
+		buf := new(bytes.Buffer)
+		_, err := nvp.Write(buf)
+		Expect(err).To(BeNil())
+
+		read := make(NameValuePairs)
+		_, err = read.Read(buf)
+		Expect(err).To(BeNil())
+		Expect(read).To(Equal(NameValuePairs{
+			"set-cookie":   {"a=1", "b=2"},
+			"content-type": {"text/plain"},
+		}))
+
+		read.Del("set-cookie")
+		Expect(read.Get("set-cookie")).To(Equal(""))
+	})
+})
+
+var _ = Describe("Name/Value pair validation", func() {
+	block := func(pairs ...string) *bytes.Buffer {
+		buf := new(bytes.Buffer)
+		writeWord(buf, uint32(len(pairs)/2))
+		for _, s := range pairs {
+			writeBytes(buf, []byte(s))
+		}
+		return buf
+	}
+
+	expectProtocolError := func(pairs ...string) {
+		r := block(pairs...)
+		_, err := make(NameValuePairs).Read(r)
+		Expect(err).To(BeAssignableToTypeOf(&StreamError{}))
+		Expect(err.(*StreamError).StatusCode).To(Equal(ProtocolError))
+		// The rest of the block must still have been consumed
+		Expect(r.Len()).To(Equal(0))
+	}
+
+	It("must reject a zero-length name with a stream error", func() {
+		expectProtocolError("", "value", "next", "pair")
+	})
+
+	It("must reject upper case names", func() {
+		expectProtocolError("Host", "example.com")
+	})
+
+	It("must reject duplicate header names", func() {
+		expectProtocolError("a", "1", "a", "2")
+	})
+
+	It("must reject values starting or ending with NUL", func() {
+		expectProtocolError("a", "\x00b")
+		expectProtocolError("a", "b\x00")
+	})
+
+	It("must reject empty values between NULs", func() {
+		expectProtocolError("a", "b\x00\x00c")
+	})
+
+	It("should accept empty and multiple header values", func() {
+		nvp := make(NameValuePairs)
+		_, err := nvp.Read(block("a", "", "b", "1\x002\x003"))
+		Expect(err).To(BeNil())
+		Expect(nvp).To(Equal(NameValuePairs{"a": {""}, "b": {"1", "2", "3"}}))
+	})
+})
+
+var _ = Describe("SYN_STREAM", func() {
+	var synStreamBody = []byte{
+		0x00, 0x00, 0x02, 0x9A, // |X|           Stream-ID (31bits)     |
+		0x49, 0x96, 0x02, 0xD2, // |X| Associated-To-Stream-ID (31bits) |
+		0xA0, 0x00, // | Pri|Unused | Slot |
+		0x00, 0x01, 0x02, 0x03, // | Raw headers...                     |
+	}
+	var synStream *SynStream
+
+	BeforeEach(func() {
+		synStream = new(SynStream)
+		_, err := synStream.Read(bytes.NewBuffer(synStreamBody))
+		Expect(err).To(BeNil())
+	})
+
+	It("should be type 1", func() {
+		Expect(SynStreamType).To(Equal(FrameType(1)))
+	})
+
+	It("should parse its stream ids", func() {
+		Expect(synStream.StreamId).To(Equal(uint32(666)))
+		Expect(synStream.AssociatedStreamId).To(Equal(uint32(1234567890)))
+	})
+
+	It("should parse its priority", func() {
+		Expect(synStream.Priority).To(Equal(uint8(5)))
+	})
+
+	It("should parse its raw headers", func() {
+		Expect(synStream.CompressedHeaders).To(Equal(
+			CompressedNameValuePairs{0x00, 0x01, 0x02, 0x03}))
+	})
+})
+
+var _ = Describe("SYN_REPLY", func() {
+	var synReplyBody = []byte{
+		0x00, 0x00, 0x02, 0x9A, // |X|           Stream-ID (31bits)     |
+		0x00, 0x01, 0x02, 0x03, // | Raw headers...                     |
+	}
+	var synReply *SynReply
+
+	BeforeEach(func() {
+		synReply = new(SynReply)
+		_, err := synReply.Read(bytes.NewBuffer(synReplyBody))
+		Expect(err).To(BeNil())
+	})
+
+	It("should be type 2", func() {
+		Expect(SynReplyType).To(Equal(FrameType(2)))
+	})
+
+	It("should parse its stream id", func() {
+		Expect(synReply.StreamId).To(Equal(uint32(666)))
+	})
+
+	It("should parse its raw headers", func() {
+		Expect(synReply.CompressedHeaders).To(Equal(
+			CompressedNameValuePairs{0x00, 0x01, 0x02, 0x03}))
+	})
+})
+
+var _ = Describe("RST_STREAM", func() {
+	var rstStreamBody = []byte{
+		0x00, 0x00, 0x02, 0x9B, // |X|          Stream-ID (31bits)    |
+		0x00, 0x00, 0x00, 0x32, // |          Status code             |
+	}
+	var rstStream *RstStream
+
+	BeforeEach(func() {
+		rstStream = new(RstStream)
+		_, err := rstStream.Read(bytes.NewBuffer(rstStreamBody))
+		Expect(err).To(BeNil())
+	})
+
+	It("should be type 3", func() {
+		Expect(RstStreamType).To(Equal(FrameType(3)))
+	})
+
+	It("should read its stream id", func() {
+		Expect(rstStream.StreamId).To(Equal(uint32(667)))
+	})
+
+	It("should read its status code", func() {
+		Expect(rstStream.StatusCode).To(Equal(RstStreamStatus(50)))
+	})
+})
+
+var _ = Describe("SETTINGS", func() {
+	It("should be type 4", func() {
+		Expect(SettingsType).To(Equal(FrameType(4)))
+	})
+
+	It("should read an empty settings frame", func() {
+		r := bytes.NewBuffer([]byte{
+			0x00, 0x00, 0x00, 0x00, // |         Number of entries        |
+		})
+		settings := new(Settings)
+		_, err := settings.Read(r)
+		Expect(err).To(BeNil())
+		Expect(settings.Settings).To(HaveLen(0))
+	})
+
+	It("should read a populated settings frame", func() {
+		r := bytes.NewBuffer([]byte{
+			0x00, 0x00, 0x00, 0x01, // |         Number of entries        |
+			0x01, 0x00, 0x00, 0x23, // | Flags(8) |      ID (24 bits)     |
+			0x00, 0x00, 0x02, 0x9C, // |          Value (32 bits)         |
+		})
+		settings := new(Settings)
+		_, err := settings.Read(r)
+		Expect(err).To(BeNil())
+		Expect(settings.Settings).To(HaveLen(1))
+		s0 := settings.Settings[0]
+		Expect(s0.Flags).To(Equal(uint8(1)))
+		Expect(s0.Id).To(Equal(SettingsId(35)))
+		Expect(s0.Value).To(Equal(int32(668)))
+	})
+})
+
+var _ = Describe("Flag/Id Word", func() {
+	It("should put the flags in the high byte and the id below", func() {
+		buf := new(bytes.Buffer)
+		NewFlagIdWord(FlagSettingsPersisted, SettingsInitialWindowSize).Write(buf)
+		Expect(buf.Bytes()).To(Equal([]byte{0x02, 0x00, 0x00, 0x07}))
+	})
+
+	It("should keep 24 bits of id", func() {
+		word := NewFlagIdWord(0xFF, SettingsId(0xABCDEF12))
+		Expect(word.Flags()).To(Equal(uint8(0xFF)))
+		Expect(word.Id()).To(Equal(SettingsId(0xCDEF12)))
+	})
+})
+
+var _ = Describe("Settings helpers", func() {
+	var settings *Settings
+
+	BeforeEach(func() {
+		settings = new(Settings)
+		settings.Set(SettingsMaxConcurrentStreams, 100, 0)
+		settings.Set(SettingsRoundTripTime, 20, FlagSettingsPersistValue)
+	})
+
+	It("should look up values by id", func() {
+		value, ok := settings.Value(SettingsMaxConcurrentStreams)
+		Expect(ok).To(BeTrue())
+		Expect(value).To(Equal(int32(100)))
+		_, ok = settings.Value(SettingsCurrentCwnd)
+		Expect(ok).To(BeFalse())
+
+		setting, ok := settings.Get(SettingsRoundTripTime)
+		Expect(ok).To(BeTrue())
+		Expect(setting.Flags).To(Equal(FlagSettingsPersistValue))
+	})
+
+	It("should replace existing values", func() {
+		settings.Set(SettingsMaxConcurrentStreams, 5, FlagSettingsPersisted)
+		Expect(settings.Settings).To(HaveLen(2))
+		value, _ := settings.Value(SettingsMaxConcurrentStreams)
+		Expect(value).To(Equal(int32(5)))
+	})
+
+	It("should delete values", func() {
+		settings.Del(SettingsMaxConcurrentStreams)
+		Expect(settings.Settings).To(HaveLen(1))
+		_, ok := settings.Get(SettingsMaxConcurrentStreams)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should name its ids", func() {
+		Expect(SettingsInitialWindowSize.String()).To(Equal("SETTINGS_INITIAL_WINDOW_SIZE"))
+		Expect(SettingsClientCertificateVectorSize).To(Equal(SettingsId(8)))
+	})
+})
+
+var _ = Describe("PING", func() {
+	It("should be type 6", func() {
+		Expect(PingType).To(Equal(FrameType(6)))
+	})
+
+	It("should read", func() {
+		r := bytes.NewBuffer([]byte{
+			0x00, 0x00, 0x66, 0x12, // |            32-bit ID             |
+		})
+		ping := new(Ping)
+		_, err := ping.Read(r)
+		Expect(err).To(BeNil())
+		Expect(ping.Id).To(Equal(uint32(26130)))
+	})
+})
+
+var _ = Describe("GOAWAY", func() {
+	It("should be type 7", func() {
+		Expect(GoAwayType).To(Equal(FrameType(7)))
+	})
+
+	It("should read", func() {
+		r := bytes.NewBuffer([]byte{
+			0x00, 0x00, 0x02, 0x9A, // |X|  Last-good-stream-ID (31 bits) |
+			0x00, 0x00, 0x24, 0x68, // |          Status code             |
+		})
+		goaway := new(GoAway)
+		_, err := goaway.Read(r)
+		Expect(err).To(BeNil())
+		Expect(goaway.LastGoodStreamId).To(Equal(uint32(666)))
+		Expect(goaway.StatusCode).To(Equal(GoAwayStatus(9320)))
+	})
+})
+
+var _ = Describe("HEADERS", func() {
+	It("should be type 8", func() {
+		Expect(HeadersType).To(Equal(FrameType(8)))
+	})
+
+	It("should read", func() {
+		var r = bytes.NewBuffer([]byte{
+			0x00, 0x00, 0x02, 0x9A, // |X|           Stream-ID (31bits)     |
+			0x03, 0x02, 0x01, 0x00, // | Raw headers...                     |
+		})
+
+		headers := new(Headers)
+		_, err := headers.Read(r)
+		Expect(err).To(BeNil())
+
+		Expect(headers.StreamId).To(Equal(uint32(666)))
+		Expect(headers.CompressedHeaders).To(Equal(
+			CompressedNameValuePairs{0x03, 0x02, 0x01, 0x00}))
+	})
+})
+
+var _ = Describe("WINDOW_UPDATE", func() {
+	It("should be type 9", func() {
+		Expect(WindowUpdateType).To(Equal(FrameType(9)))
+	})
+
+	It("should read", func() {
+		var r = bytes.NewBuffer([]byte{
+			0x00, 0x00, 0x02, 0x99, // |X|     Stream-ID (31-bits)        |
+			0x00, 0x00, 0x00, 0x99, // |X|  Delta-Window-Size (31-bits)   |
+		})
+		windowUpdate := new(WindowUpdate)
+		_, err := windowUpdate.Read(r)
+		Expect(err).To(BeNil())
+
+		Expect(windowUpdate.StreamId).To(Equal(uint32(665)))
+		Expect(windowUpdate.DeltaWindowSize).To(Equal(uint32(153)))
+	})
+})
+
+var _ = Describe("CREDENTIAL", func() {
+	It("should be type 10", func() {
+		Expect(CredentialType).To(Equal(FrameType(10)))
+	})
+
+	It("should read", func() {
+		var r = bytes.NewBuffer([]byte{
+			0x00, 0x02, // |  Slot (16 bits) |
+			0x00, 0x00, 0x00, 0x02, // |      Proof Length (32 bits)      |
+			0xAB, 0xCD, // |               Proof              |
+			0x00, 0x00, 0x00, 0x01, // |   Certificate Length (32 bits)   |
+			0x01,                   // |            Certificate           |
+			0x00, 0x00, 0x00, 0x03, // |   Certificate Length (32 bits)   |
+			0x02, 0x03, 0x04, // |            Certificate           |
+		})
+		credential := new(Credential)
+		_, err := credential.Read(r)
+		Expect(err).To(BeNil())
+
+		Expect(credential.Slot).To(Equal(uint16(2)))
+		Expect(credential.Proof).To(Equal([]byte{0xAB, 0xCD}))
+		Expect(credential.Certificates).To(Equal([][]byte{
+			{0x01},
+			{0x02, 0x03, 0x04},
+		}))
+	})
+
+	It("should not trust lengths longer than the frame", func() {
+		for _, body := range [][]byte{
+			{0x00, 0x01, 0xFF, 0xFF, 0xFF, 0xFF},
+			{0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0xFF, 0xFF},
+		} {
+			_, err := new(Credential).Read(bytes.NewBuffer(body))
+			Expect(err).To(Equal(io.ErrUnexpectedEOF))
+		}
+	})
 })
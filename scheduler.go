@@ -0,0 +1,117 @@
+package spdy3
+
+// The lowest of the eight stream priorities. Zero is the highest.
+const lowestPriority = 7
+
+// ----------------------------------------------------------------------------
+// Write Scheduler
+//
+// A writeScheduler orders the frames waiting to be written to a session's
+// connection. Control frames always go first, in the order they were queued.
+// DATA frames follow by the priority of their stream, and streams of the same
+// priority take turns one frame at a time. Stream.Write queues no more than
+// maxDataFrameSize at once, so a bulk transfer at a low priority only ever
+// holds up a more important stream by a single frame.
+type writeScheduler struct {
+	control []*writeRequest
+
+	// Each priority has a queue of frames per stream. The stream at the head
+	// of a priority's list goes next, then moves to the back if it has more.
+	data    [lowestPriority + 1][]*streamWrites
+	streams map[uint32]*streamWrites
+}
+
+type streamWrites struct {
+	id       uint32
+	priority uint8
+	writes   []*writeRequest
+}
+
+func newWriteScheduler() *writeScheduler {
+	return &writeScheduler{
+		streams: make(map[uint32]*streamWrites),
+	}
+}
+
+// push queues a request. DATA frames are scheduled by the request's priority,
+// anything else is a control frame.
+func (w *writeScheduler) push(req *writeRequest) {
+	frame, ok := req.frame.(*DataFrame)
+	if !ok {
+		w.control = append(w.control, req)
+		return
+	}
+
+	stream, ok := w.streams[frame.StreamId]
+	if !ok {
+		priority := req.priority
+		if priority > lowestPriority {
+			priority = lowestPriority
+		}
+		stream = &streamWrites{id: frame.StreamId, priority: priority}
+		w.streams[stream.id] = stream
+		w.data[priority] = append(w.data[priority], stream)
+	}
+	stream.writes = append(stream.writes, req)
+}
+
+// pop takes the request which should be written next, or nil if there are none.
+func (w *writeScheduler) pop() *writeRequest {
+	if len(w.control) > 0 {
+		req := w.control[0]
+		w.control = w.control[1:]
+		return req
+	}
+
+	for priority, streams := range w.data {
+		if len(streams) == 0 {
+			continue
+		}
+		stream := streams[0]
+		req := stream.writes[0]
+		stream.writes = stream.writes[1:]
+
+		streams = streams[1:]
+		if len(stream.writes) > 0 {
+			streams = append(streams, stream)
+		} else {
+			delete(w.streams, stream.id)
+		}
+		w.data[priority] = streams
+		return req
+	}
+	return nil
+}
+
+// remove takes the DATA frames still queued for a stream out of the schedule,
+// and returns their requests.
+func (w *writeScheduler) remove(id uint32) []*writeRequest {
+	stream, ok := w.streams[id]
+	if !ok {
+		return nil
+	}
+	delete(w.streams, id)
+
+	streams := w.data[stream.priority]
+	for i := range streams {
+		if streams[i] == stream {
+			w.data[stream.priority] = append(streams[:i], streams[i+1:]...)
+			break
+		}
+	}
+	return stream.writes
+}
+
+func (w *writeScheduler) empty() bool {
+	return len(w.control) == 0 && len(w.streams) == 0
+}
+
+// drain takes every queued request, in no particular order.
+func (w *writeScheduler) drain() []*writeRequest {
+	reqs := w.control
+	for _, stream := range w.streams {
+		reqs = append(reqs, stream.writes...)
+	}
+	*w = *newWriteScheduler()
+	return reqs
+}
@@ -0,0 +1,137 @@
+package spdy3
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Write scheduler", func() {
+	var scheduler *writeScheduler
+
+	BeforeEach(func() {
+		scheduler = newWriteScheduler()
+	})
+
+	data := func(id uint32, priority uint8) *writeRequest {
+		return &writeRequest{
+			frame:    &DataFrame{StreamId: id},
+			priority: priority,
+		}
+	}
+
+	// popAll empties the scheduler, returning the frames in the order they
+	// would be written.
+	popAll := func() (frames []Frame) {
+		for !scheduler.empty() {
+			frames = append(frames, scheduler.pop().frame)
+		}
+		return
+	}
+
+	It("should be empty to begin with", func() {
+		Expect(scheduler.empty()).To(BeTrue())
+		Expect(scheduler.pop()).To(BeNil())
+	})
+
+	It("should send control frames first, in order", func() {
+		scheduler.push(data(1, 0))
+		scheduler.push(&writeRequest{frame: &Ping{Id: 1}, priority: 7})
+		scheduler.push(&writeRequest{frame: &Ping{Id: 2}, priority: 7})
+
+		Expect(popAll()).To(Equal([]Frame{
+			&Ping{Id: 1},
+			&Ping{Id: 2},
+			&DataFrame{StreamId: 1},
+		}))
+	})
+
+	It("should send data by priority", func() {
+		scheduler.push(data(1, 7))
+		scheduler.push(data(3, 2))
+		scheduler.push(data(5, 0))
+
+		Expect(popAll()).To(Equal([]Frame{
+			&DataFrame{StreamId: 5},
+			&DataFrame{StreamId: 3},
+			&DataFrame{StreamId: 1},
+		}))
+	})
+
+	It("should take turns between streams of a priority", func() {
+		scheduler.push(data(1, 3))
+		scheduler.push(data(1, 3))
+		scheduler.push(data(1, 3))
+		scheduler.push(data(3, 3))
+		scheduler.push(data(3, 3))
+
+		Expect(popAll()).To(Equal([]Frame{
+			&DataFrame{StreamId: 1},
+			&DataFrame{StreamId: 3},
+			&DataFrame{StreamId: 1},
+			&DataFrame{StreamId: 3},
+			&DataFrame{StreamId: 1},
+		}))
+	})
+
+	It("should keep each stream's frames in order", func() {
+		scheduler.push(&writeRequest{frame: &DataFrame{StreamId: 1, Data: []byte("a")}})
+		scheduler.push(&writeRequest{frame: &DataFrame{StreamId: 1, Flags: FlagFin}})
+
+		Expect(popAll()).To(Equal([]Frame{
+			&DataFrame{StreamId: 1, Data: []byte("a")},
+			&DataFrame{StreamId: 1, Flags: FlagFin},
+		}))
+	})
+
+	It("should remove a stream's frames", func() {
+		scheduler.push(data(1, 3))
+		scheduler.push(data(3, 3))
+		scheduler.push(data(1, 3))
+		scheduler.push(data(5, 3))
+		scheduler.push(&writeRequest{frame: &Ping{Id: 1}})
+
+		Expect(scheduler.remove(1)).To(HaveLen(2))
+		Expect(scheduler.remove(1)).To(BeEmpty())
+		Expect(popAll()).To(Equal([]Frame{
+			&Ping{Id: 1},
+			&DataFrame{StreamId: 3},
+			&DataFrame{StreamId: 5},
+		}))
+	})
+
+	It("should drain everything", func() {
+		scheduler.push(data(1, 0))
+		scheduler.push(data(3, 4))
+		scheduler.push(&writeRequest{frame: &Ping{Id: 1}})
+
+		Expect(scheduler.drain()).To(HaveLen(3))
+		Expect(scheduler.empty()).To(BeTrue())
+	})
+})
+
+var _ = Describe("Stream priorities", func() {
+	var (
+		session *Session
+		peer    *Framer
+	)
+
+	BeforeEach(func() {
+		session, peer = newPeer(false, nil)
+	})
+
+	AfterEach(func() {
+		session.Close()
+	})
+
+	It("should open streams at a priority", func() {
+		go session.OpenStreamWithPriority(NameValuePairs{}, 5)
+		frame := readFrame(peer).(*SynStream)
+		Expect(frame.Priority).To(Equal(uint8(5)))
+		Expect(session.getStream(1).Priority()).To(Equal(uint8(5)))
+	})
+
+	It("should not open streams below the lowest priority", func() {
+		_, err := session.OpenStreamWithPriority(NameValuePairs{}, 8)
+		Expect(err).To(Equal(ErrBadPriority))
+	})
+})
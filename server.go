@@ -0,0 +1,406 @@
+package spdy3
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrMissingHeaders = errors.New("Request is missing a required header")
+
+// ----------------------------------------------------------------------------
+// HTTP Server
+//
+// A Server serves HTTP over SPDY with an http.Handler. Each stream a client
+// opens is one request: its SYN_STREAM carries the request line as :method,
+// :path, :version, :host and :scheme headers alongside the usual ones, and its
+// DATA frames the body. The response goes back as a SYN_REPLY holding :status
+// and :version, followed by DATA frames.
+type Server struct {
+	// The handler to serve requests with, or http.DefaultServeMux if nil.
+	Handler http.Handler
+
+	// The configuration each session is started with.
+	Config *Config
+
+	// How long a TLS client has to finish its handshake before its connection
+	// is closed. Zero is 10 seconds.
+	HandshakeTimeout time.Duration
+}
+
+// Serve accepts connections from l and serves each of them in its own
+// goroutine. It returns the first error l.Accept does. TLS connections, such
+// as those from ListenTLS, speak whichever version of SPDY the client picked,
+// or HTTP/1.1 if it picked none.
+func (srv *Server) Serve(l net.Listener) error {
+	fallback := newFallbackListener(l.Addr())
+	defer fallback.Close()
+	go serveFallback(fallback, srv.handler())
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.serveConn(conn, fallback)
+	}
+}
+
+func (srv *Server) serveConn(conn net.Conn, fallback *fallbackListener) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		srv.ServeConn(conn)
+		return
+	}
+
+	timeout := srv.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	version, ok := negotiatedVersion(tlsConn)
+	if !ok {
+		fallback.serve(conn)
+		return
+	}
+	srv.serveSession(NewSession(conn, true, withVersion(srv.Config, version)))
+}
+
+// ServeConn starts a server session over conn, and serves its requests until
+// the session closes.
+func (srv *Server) ServeConn(conn net.Conn) {
+	srv.serveSession(NewSession(conn, true, srv.Config))
+}
+
+func (srv *Server) serveSession(session *Session) {
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go srv.serveStream(stream)
+	}
+}
+
+func (srv *Server) handler() http.Handler {
+	if srv.Handler == nil {
+		return http.DefaultServeMux
+	}
+	return srv.Handler
+}
+
+func (srv *Server) serveStream(stream *Stream) {
+	req, err := newRequest(stream)
+	if err != nil {
+		// A request which is not valid HTTP is still answered in HTTP
+		stream.closeWrite(NameValuePairs{
+			":status":  {statusLine(http.StatusBadRequest)},
+			":version": {"HTTP/1.1"},
+		})
+		stream.closeRead()
+		return
+	}
+	srv.serve(stream, req, false)
+}
+
+// serve runs the handler for a request, and sends its response on stream. A
+// handler which panics has its stream reset.
+func (srv *Server) serve(stream *Stream, req *http.Request, pushed bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			if err != http.ErrAbortHandler {
+				buf := make([]byte, 64<<10)
+				buf = buf[:runtime.Stack(buf, false)]
+				log.Printf("spdy3: panic serving %s: %v\n%s", req.RemoteAddr, err, buf)
+			}
+			stream.Reset(InternalError)
+		}
+	}()
+
+	w := &responseWriter{
+		srv:    srv,
+		stream: stream,
+		req:    req,
+		pushed: pushed,
+		header: make(http.Header),
+	}
+	w.buf = bufio.NewWriter(stream)
+	srv.handler().ServeHTTP(w, req)
+	w.finish()
+}
+
+// newRequest builds the request a client opened a stream with. Its context is
+// cancelled along with the stream.
+func newRequest(stream *Stream) (*http.Request, error) {
+	headers := stream.Headers()
+	method := headers.Get(":method")
+	path := headers.Get(":path")
+	version := headers.Get(":version")
+	scheme := headers.Get(":scheme")
+	host := headers.Get(":host")
+	if method == "" || path == "" || version == "" || scheme == "" || host == "" {
+		return nil, ErrMissingHeaders
+	}
+
+	major, minor, ok := http.ParseHTTPVersion(version)
+	if !ok {
+		return nil, fmt.Errorf("spdy3: bad HTTP version %q", version)
+	}
+	u, err := url.ParseRequestURI(path)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme, u.Host = scheme, host
+
+	header := make(http.Header)
+	for name, values := range headers {
+		if !strings.HasPrefix(name, ":") {
+			header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+
+	req := &http.Request{
+		Method:        method,
+		URL:           u,
+		Proto:         version,
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        header,
+		Host:          host,
+		RequestURI:    path,
+		RemoteAddr:    stream.session.conn.RemoteAddr().String(),
+		ContentLength: -1,
+		Body:          &requestBody{stream},
+	}
+
+	stream.mu.Lock()
+	empty := stream.remoteClosed && stream.buf.Len() == 0
+	stream.mu.Unlock()
+	if empty {
+		req.ContentLength = 0
+		req.Body = http.NoBody
+	} else if length := header.Get("Content-Length"); length != "" {
+		if req.ContentLength, err = strconv.ParseInt(length, 10, 64); err != nil {
+			return nil, fmt.Errorf("spdy3: bad Content-Length %q", length)
+		}
+	}
+
+	if conn, ok := stream.session.conn.(*tls.Conn); ok {
+		state := conn.ConnectionState()
+		req.TLS = &state
+	}
+	return req.WithContext(stream.Context()), nil
+}
+
+// requestBody reads a request's body from its stream. Closing it only stops
+// reading, leaving the response free to carry on.
+type requestBody struct {
+	stream *Stream
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	return b.stream.Read(p)
+}
+
+func (b *requestBody) Close() error {
+	b.stream.closeRead()
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// Response Writer
+//
+// A responseWriter sends a handler's response on its stream, buffering the
+// body until it is flushed. The headers of a pushed response go in a HEADERS
+// frame, as a pushed stream has no SYN_REPLY. Trailers are sent in a HEADERS
+// frame after the body.
+type responseWriter struct {
+	srv    *Server
+	stream *Stream
+	req    *http.Request
+	pushed bool
+
+	header      http.Header
+	wroteHeader bool
+	trailers    []string
+	buf         *bufio.Writer
+	err         error
+}
+
+// Headers which only make sense for a single HTTP/1.1 connection, and are not
+// allowed in SPDY.
+var hopByHopHeaders = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Transfer-Encoding": true,
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	headers := make(NameValuePairs)
+	for name, values := range w.header {
+		switch {
+		case hopByHopHeaders[name], strings.HasPrefix(name, http.TrailerPrefix):
+			continue
+		case name == "Trailer":
+			for _, value := range values {
+				for _, trailer := range strings.Split(value, ",") {
+					trailer = http.CanonicalHeaderKey(strings.TrimSpace(trailer))
+					w.trailers = append(w.trailers, trailer)
+				}
+			}
+		}
+		for _, value := range values {
+			headers.Add(name, value)
+		}
+	}
+	headers.Set(":status", statusLine(code))
+	headers.Set(":version", "HTTP/1.1")
+
+	if w.pushed {
+		w.err = w.stream.WriteHeaders(headers)
+	} else {
+		w.err = w.stream.Reply(headers)
+	}
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		if _, ok := w.header["Content-Type"]; !ok {
+			w.header.Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	// The response to a HEAD has no body, only the FIN which ends it
+	if w.req.Method == "HEAD" {
+		return len(p), nil
+	}
+	return w.buf.Write(p)
+}
+
+// Flush sends any buffered data to the client straight away.
+func (w *responseWriter) Flush() {
+	w.WriteHeader(http.StatusOK)
+	w.buf.Flush()
+}
+
+// Push pushes the response to a GET or HEAD of target, which must be a path or
+// a URL with the same scheme and host as the request being served. The pushed
+// request is served by the same handler.
+func (w *responseWriter) Push(target string, opts *http.PushOptions) error {
+	if w.pushed {
+		return http.ErrNotSupported
+	}
+	if opts == nil {
+		opts = new(http.PushOptions)
+	}
+
+	method := opts.Method
+	if method == "" {
+		method = "GET"
+	}
+	if method != "GET" && method != "HEAD" {
+		return fmt.Errorf("spdy3: cannot push a %s request", method)
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" {
+		if !strings.HasPrefix(target, "/") {
+			return fmt.Errorf("spdy3: cannot push relative path %q", target)
+		}
+		u.Scheme, u.Host = w.req.URL.Scheme, w.req.Host
+	} else if u.Scheme != w.req.URL.Scheme || u.Host != w.req.Host {
+		return fmt.Errorf("spdy3: cannot push %q from another origin", target)
+	}
+
+	headers := make(NameValuePairs)
+	for name, values := range opts.Header {
+		for _, value := range values {
+			headers.Add(name, value)
+		}
+	}
+	headers.Set(":method", method)
+	headers.Set(":path", u.RequestURI())
+	headers.Set(":version", "HTTP/1.1")
+	headers.Set(":scheme", u.Scheme)
+	headers.Set(":host", u.Host)
+
+	stream, err := w.stream.Push(headers)
+	if err != nil {
+		return err
+	}
+	req, err := newRequest(stream)
+	if err != nil {
+		stream.Reset(InternalError)
+		return err
+	}
+	go w.srv.serve(stream, req, true)
+	return nil
+}
+
+// finish sends whatever is left of the response once the handler has returned,
+// and closes the stream.
+func (w *responseWriter) finish() {
+	w.Flush()
+
+	trailers := make(NameValuePairs)
+	for _, name := range w.trailers {
+		for _, value := range w.header[name] {
+			trailers.Add(name, value)
+		}
+	}
+	for name, values := range w.header {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			for _, value := range values {
+				trailers.Add(strings.TrimPrefix(name, http.TrailerPrefix), value)
+			}
+		}
+	}
+	if len(trailers) > 0 && w.err == nil {
+		w.stream.WriteHeaders(trailers)
+	}
+
+	w.stream.Close()
+}
+
+func statusLine(code int) string {
+	if text := http.StatusText(code); text != "" {
+		return strconv.Itoa(code) + " " + text
+	}
+	return strconv.Itoa(code)
+}
+
+// Ensure responseWriter supports flushing and server push
+var (
+	_ http.Flusher = &responseWriter{}
+	_ http.Pusher  = &responseWriter{}
+)
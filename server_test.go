@@ -0,0 +1,296 @@
+package spdy3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Server", func() {
+	var (
+		client  *Session
+		handler http.HandlerFunc
+		pushes  chan *Stream
+	)
+
+	BeforeEach(func() {
+		pushes = make(chan *Stream, 1)
+		clientConn, serverConn := net.Pipe()
+		client = NewSession(clientConn, false, &Config{
+			PushHandler: func(associated, pushed *Stream) RstStreamStatus {
+				pushes <- pushed
+				return 0
+			},
+		})
+
+		server := &Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handler(w, r)
+			}),
+		}
+		go server.ServeConn(serverConn)
+	})
+
+	AfterEach(func() {
+		client.Close()
+	})
+
+	request := func(method, path string) NameValuePairs {
+		return NameValuePairs{
+			":method":  {method},
+			":path":    {path},
+			":version": {"HTTP/1.1"},
+			":scheme":  {"https"},
+			":host":    {"example.com"},
+		}
+	}
+
+	It("should serve requests", func() {
+		requests := make(chan *http.Request, 1)
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			requests <- r
+			w.Header().Set("X-Answer", "42")
+			fmt.Fprint(w, "hello")
+		}
+
+		headers := request("GET", "/greet?name=world")
+		headers.Set("accept", "text/plain")
+		stream, err := client.OpenStream(headers)
+		Expect(err).To(BeNil())
+		Expect(stream.CloseWrite()).To(Succeed())
+
+		reply, err := stream.ReplyHeaders()
+		Expect(err).To(BeNil())
+		Expect(reply.Get(":status")).To(Equal("200 OK"))
+		Expect(reply.Get(":version")).To(Equal("HTTP/1.1"))
+		Expect(reply.Get("x-answer")).To(Equal("42"))
+		Expect(reply.Get("content-type")).To(Equal("text/plain; charset=utf-8"))
+		Expect(ioutil.ReadAll(stream)).To(Equal([]byte("hello")))
+
+		var r *http.Request
+		Eventually(requests).Should(Receive(&r))
+		Expect(r.Method).To(Equal("GET"))
+		Expect(r.URL.String()).To(Equal("https://example.com/greet?name=world"))
+		Expect(r.Host).To(Equal("example.com"))
+		Expect(r.RequestURI).To(Equal("/greet?name=world"))
+		Expect(r.ProtoMajor).To(Equal(1))
+		Expect(r.ProtoMinor).To(Equal(1))
+		Expect(r.Header.Get("Accept")).To(Equal("text/plain"))
+	})
+
+	It("should send no body in response to HEAD", func() {
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "5")
+			n, err := fmt.Fprint(w, "hello")
+			Expect(n).To(Equal(5))
+			Expect(err).To(BeNil())
+		}
+
+		stream, err := client.OpenStream(request("HEAD", "/"))
+		Expect(err).To(BeNil())
+		Expect(stream.CloseWrite()).To(Succeed())
+
+		reply, err := stream.ReplyHeaders()
+		Expect(err).To(BeNil())
+		Expect(reply.Get(":status")).To(Equal("200 OK"))
+		Expect(reply.Get("content-length")).To(Equal("5"))
+		Expect(ioutil.ReadAll(stream)).To(BeEmpty())
+	})
+
+	It("should pass request bodies to the handler", func() {
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			io.Copy(w, r.Body)
+		}
+
+		stream, err := client.OpenStream(request("POST", "/echo"))
+		Expect(err).To(BeNil())
+		go func() {
+			defer GinkgoRecover()
+			stream.Write([]byte("echo"))
+			stream.CloseWrite()
+		}()
+
+		reply, err := stream.ReplyHeaders()
+		Expect(err).To(BeNil())
+		Expect(reply.Get(":status")).To(Equal("201 Created"))
+		Expect(ioutil.ReadAll(stream)).To(Equal([]byte("echo")))
+	})
+
+	It("should flush data before the handler returns", func() {
+		release := make(chan struct{})
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "first")
+			w.(http.Flusher).Flush()
+			<-release
+			fmt.Fprint(w, "second")
+		}
+
+		stream, err := client.OpenStream(request("GET", "/"))
+		Expect(err).To(BeNil())
+
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(stream, buf)
+		Expect(err).To(BeNil())
+		Expect(string(buf)).To(Equal("first"))
+
+		close(release)
+		Expect(ioutil.ReadAll(stream)).To(Equal([]byte("second")))
+	})
+
+	It("should send trailers after the body", func() {
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Trailer", "X-Checksum")
+			fmt.Fprint(w, "body")
+			w.Header().Set("X-Checksum", "abc")
+			w.Header().Set(http.TrailerPrefix+"X-Late", "def")
+		}
+
+		// The trailers may arrive before the reply is looked at, so only the
+		// SYN_REPLY's own headers are checked for them
+		stream, err := client.OpenStream(request("GET", "/"))
+		Expect(err).To(BeNil())
+		reply, err := stream.waitForReply(false)
+		Expect(err).To(BeNil())
+		Expect(reply).NotTo(HaveKey("x-checksum"))
+		Expect(reply.Get("trailer")).To(Equal("X-Checksum"))
+
+		Expect(ioutil.ReadAll(stream)).To(Equal([]byte("body")))
+		reply, err = stream.ReplyHeaders()
+		Expect(err).To(BeNil())
+		Expect(reply.Get("x-checksum")).To(Equal("abc"))
+		Expect(reply.Get("x-late")).To(Equal("def"))
+	})
+
+	It("should push responses", func() {
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/style.css" {
+				w.Header().Set("Content-Type", "text/css")
+				fmt.Fprint(w, "body {}")
+				return
+			}
+			Expect(w.(http.Pusher).Push("/style.css", nil)).To(Succeed())
+			fmt.Fprint(w, "<html>")
+		}
+
+		stream, err := client.OpenStream(request("GET", "/"))
+		Expect(err).To(BeNil())
+
+		var pushed *Stream
+		Eventually(pushes).Should(Receive(&pushed))
+		Expect(pushed.Headers().Get(":path")).To(Equal("/style.css"))
+		Expect(pushed.Headers().Get(":host")).To(Equal("example.com"))
+		Expect(ioutil.ReadAll(pushed)).To(Equal([]byte("body {}")))
+
+		reply, err := pushed.ReplyHeaders()
+		Expect(err).To(BeNil())
+		Expect(reply.Get(":status")).To(Equal("200 OK"))
+		Expect(reply.Get("content-type")).To(Equal("text/css"))
+
+		Expect(ioutil.ReadAll(stream)).To(Equal([]byte("<html>")))
+	})
+
+	It("should answer requests missing their request line with a 400", func() {
+		stream, err := client.OpenStream(NameValuePairs{":path": {"/"}})
+		Expect(err).To(BeNil())
+		reply, err := stream.ReplyHeaders()
+		Expect(err).To(BeNil())
+		Expect(reply.Get(":status")).To(Equal("400 Bad Request"))
+		Expect(reply.Get(":version")).To(Equal("HTTP/1.1"))
+		Expect(ioutil.ReadAll(stream)).To(BeEmpty())
+	})
+
+	It("should answer requests with a bad Content-Length with a 400", func() {
+		headers := request("POST", "/")
+		headers.Set("content-length", "many")
+		stream, err := client.OpenStream(headers)
+		Expect(err).To(BeNil())
+		reply, err := stream.ReplyHeaders()
+		Expect(err).To(BeNil())
+		Expect(reply.Get(":status")).To(Equal("400 Bad Request"))
+	})
+
+	It("should cancel the request's context when the client resets", func() {
+		cancelled := make(chan error, 1)
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			cancelled <- r.Context().Err()
+		}
+
+		stream, err := client.OpenStream(request("GET", "/"))
+		Expect(err).To(BeNil())
+		_, err = stream.ReplyHeaders()
+		Expect(err).To(BeNil())
+		Consistently(cancelled).ShouldNot(Receive())
+
+		Expect(stream.Reset(Cancel)).To(Succeed())
+		Eventually(cancelled).Should(Receive(Equal(context.Canceled)))
+	})
+
+	It("should cancel the request's context when the session closes", func() {
+		cancelled := make(chan error, 1)
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			cancelled <- r.Context().Err()
+		}
+
+		stream, err := client.OpenStream(request("GET", "/"))
+		Expect(err).To(BeNil())
+		_, err = stream.ReplyHeaders()
+		Expect(err).To(BeNil())
+
+		client.Close()
+		Eventually(cancelled).Should(Receive(Equal(context.Canceled)))
+	})
+
+	It("should reset the stream if the handler panics", func() {
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			panic(http.ErrAbortHandler)
+		}
+
+		stream, err := client.OpenStream(request("GET", "/"))
+		Expect(err).To(BeNil())
+		_, err = ioutil.ReadAll(stream)
+		Expect(err).To(BeAssignableToTypeOf(&StreamError{}))
+		Expect(err.(*StreamError).StatusCode).To(Equal(InternalError))
+	})
+
+	It("should serve SPDY/2 clients, which have no flow control", func() {
+		clientConn, serverConn := net.Pipe()
+		client := NewSession(clientConn, false, &Config{Version: Spdy2})
+		defer client.Close()
+		server := &Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handler(w, r)
+			}),
+			Config: &Config{Version: Spdy2},
+		}
+		go server.ServeConn(serverConn)
+
+		body := bytes.Repeat([]byte("x"), 3*defaultInitialWindowSize)
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(w, r.Body)
+		}
+
+		stream, err := client.OpenStream(request("POST", "/upload"))
+		Expect(err).To(BeNil())
+		go func() {
+			stream.Write(body)
+			stream.CloseWrite()
+		}()
+
+		reply, err := stream.ReplyHeaders()
+		Expect(err).To(BeNil())
+		Expect(reply.Get(":status")).To(Equal("200 OK"))
+		Expect(ioutil.ReadAll(stream)).To(Equal(body))
+	})
+})
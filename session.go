@@ -0,0 +1,1238 @@
+package spdy3
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSessionClosed  = errors.New("Session closed")
+	ErrStreamIdsUsed  = errors.New("No stream ids left on this session")
+	ErrTooManyStreams = errors.New("Peer's concurrent stream limit reached")
+	ErrBadPriority    = errors.New("Stream priority must be from 0 to 7")
+	ErrKeepAlive      = errors.New("Peer stopped answering keepalive pings")
+	ErrShutdown       = errors.New("Session is shutting down")
+
+	// ErrGoAway fails streams the peer has said it will not process, having
+	// sent a GOAWAY. They can safely be retried on a new session.
+	ErrGoAway = errors.New("Peer went away before processing the stream")
+)
+
+const (
+	// The largest id a stream can have in its 31 bits.
+	maxStreamId = 0x7FFFFFFF
+
+	// Every stream starts with a 64KB flow control window in each direction,
+	// which may not grow past 31 bits.
+	defaultInitialWindowSize = 0x10000
+	maxWindowSize            = 0x7FFFFFFF
+)
+
+// Config holds the options of a Session. A nil *Config is the same as the
+// result of DefaultConfig, and any field left at zero takes its default.
+type Config struct {
+	// The version of SPDY to speak: Spdy2, Spdy3 or Spdy31. Sessions over TLS speak
+	// whichever version was negotiated instead.
+	Version SpdyVersion
+
+	// The number of streams the peer may have opened which have not yet been
+	// taken by AcceptStream. Any more are refused.
+	AcceptBacklog int
+
+	// Where a client keeps the settings servers ask it to persist, under the
+	// key Origin (for instance "https://example.com:443"). Ignored by servers,
+	// or if either is unset.
+	SettingsStore SettingsStore
+	Origin        string
+
+	// The most streams the peer may have open at once, advertised to it as
+	// SETTINGS_MAX_CONCURRENT_STREAMS. Any more are refused. Zero is no limit.
+	MaxConcurrentStreams int
+
+	// What OpenStream does once the peer's own limit is reached.
+	StreamLimitPolicy StreamLimitPolicy
+
+	// How often to ping the peer to check it is still there. Zero turns
+	// keepalive pings off. A ping counts as missed if it is not answered
+	// within the interval, and after MaxMissedPings in a row the session is
+	// closed with ErrKeepAlive.
+	KeepAliveInterval time.Duration
+	MaxMissedPings    int
+
+	// PushHandler is offered each stream a server pushes to a client, along
+	// with the stream it is associated with. Returning zero accepts the pushed
+	// stream, which is then the handler's to read (or to cache for later) and
+	// is not passed to AcceptStream. Returning a status such as REFUSED_STREAM
+	// or CANCEL resets it. The handler is called from the session's read loop,
+	// so must not block. Without one, pushed streams go to AcceptStream like
+	// any other.
+	PushHandler func(associated, pushed *Stream) RstStreamStatus
+
+	// The number of slots in the vector of client certificates a server keeps
+	// for CREDENTIAL frames, advertised to clients as
+	// SETTINGS_CLIENT_CERTIFICATE_VECTOR_SIZE. Zero keeps the default of 8
+	// without advertising it.
+	CredentialVectorSize int
+}
+
+// A StreamLimitPolicy decides what OpenStream does when the peer will not take
+// any more concurrent streams.
+type StreamLimitPolicy int
+
+const (
+	// Wait for one of the session's streams to close. Waiting callers are
+	// given streams in the order they called OpenStream.
+	StreamLimitWait StreamLimitPolicy = iota
+
+	// Return ErrTooManyStreams straight away.
+	StreamLimitFailFast
+)
+
+func DefaultConfig() *Config {
+	return &Config{
+		Version:        Spdy3,
+		AcceptBacklog:  256,
+		MaxMissedPings: 3,
+	}
+}
+
+// withDefaults returns a copy of the config with its zero fields filled in.
+func (c *Config) withDefaults() *Config {
+	defaults := DefaultConfig()
+	if c == nil {
+		return defaults
+	}
+
+	config := *c
+	if config.Version == 0 {
+		config.Version = defaults.Version
+	}
+	if config.AcceptBacklog <= 0 {
+		config.AcceptBacklog = defaults.AcceptBacklog
+	}
+	if config.MaxMissedPings <= 0 {
+		config.MaxMissedPings = defaults.MaxMissedPings
+	}
+	return &config
+}
+
+// ----------------------------------------------------------------------------
+// Session
+//
+// A Session multiplexes many streams over a single connection. It owns the
+// connection's read loop, which routes every incoming frame to the stream it
+// belongs to, and a write loop which sends outgoing frames in the order picked
+// by its writeScheduler.
+//
+// Stream ids are allocated by role: streams initiated by a client have odd ids,
+// streams initiated by a server have even ids.
+type Session struct {
+	conn   net.Conn
+	framer *Framer
+	server bool
+	config *Config
+
+	mu           sync.Mutex
+	streams      map[uint32]*Stream
+	nextId       uint32
+	lastRemoteId uint32
+	err          error
+
+	// The number of open streams opened by each end, and the most the peer
+	// will let us open (negative for no limit). OpenStream waits on openCond
+	// while the limit is reached, taking turns by ticket.
+	localStreams   int
+	remoteStreams  int
+	peerMaxStreams int
+	openCond       *sync.Cond
+	openTicket     uint64
+	openServed     uint64
+
+	// Set once either end has sent a GOAWAY, with goneAway closed when the
+	// peer's arrives. While we shut down, drained is closed as soon as no
+	// streams are left.
+	goAwayReceived bool
+	goneAway       chan struct{}
+	goAwaySent     chan error
+	drained        chan struct{}
+
+	// The windows new streams start with. The send window is set by the peer,
+	// the receive window is our own.
+	initialSendWindow int32
+	initialRecvWindow int32
+
+	// SPDY/3.1 also has windows for the session as a whole, which data on
+	// every stream counts against. Writers wait on windowCond for the send
+	// window to open, and read data not yet returned to the peer is held in
+	// unacked.
+	sendWindow int32
+	recvWindow int32
+	unacked    int32
+	windowCond *sync.Cond
+
+	// The write loop is writing while the frame it took from writes is on its
+	// way to the connection. Each of flushes is closed once both are done.
+	writeCond *sync.Cond
+	writes    *writeScheduler
+	writing   bool
+	flushes   []chan struct{}
+
+	// Pings we have sent which are waiting for an answer, by id.
+	nextPingId uint32
+	pings      map[uint32]chan struct{}
+
+	// A server's vector of client certificates, indexed by slot less one. A
+	// client only knows the size of the server's vector.
+	credentials    []*credential
+	peerVectorSize int
+
+	accept chan *Stream
+	closed chan struct{}
+}
+
+type writeRequest struct {
+	frame    Frame
+	priority uint8
+	done     chan error
+}
+
+// NewSession starts a session over conn. The server flag decides which half of
+// the stream id space belongs to this end of the connection.
+func NewSession(conn net.Conn, server bool, config *Config) *Session {
+	config = config.withDefaults()
+
+	s := &Session{
+		conn:    conn,
+		framer:  NewFramer(config.Version, conn),
+		server:  server,
+		config:  config,
+		streams: make(map[uint32]*Stream),
+		writes:  newWriteScheduler(),
+		pings:   make(map[uint32]chan struct{}),
+		accept:  make(chan *Stream, config.AcceptBacklog),
+		closed:  make(chan struct{}),
+
+		goneAway: make(chan struct{}),
+
+		initialSendWindow: defaultInitialWindowSize,
+		initialRecvWindow: defaultInitialWindowSize,
+		peerVectorSize:    defaultCredentialVectorSize,
+		sendWindow:        defaultInitialWindowSize,
+		recvWindow:        defaultInitialWindowSize,
+		peerMaxStreams:    -1,
+	}
+	s.writeCond = sync.NewCond(&s.mu)
+	s.openCond = sync.NewCond(&s.mu)
+	s.windowCond = sync.NewCond(&s.mu)
+
+	if server {
+		s.nextId = 2
+		s.nextPingId = 2
+		size := config.CredentialVectorSize
+		if size <= 0 {
+			size = defaultCredentialVectorSize
+		}
+		s.credentials = make([]*credential, size)
+	} else {
+		s.nextId = 1
+		s.nextPingId = 1
+	}
+
+	s.sendInitialSettings()
+
+	go s.readLoop()
+	go s.writeLoop()
+	if config.KeepAliveInterval > 0 {
+		go s.keepAlive()
+	}
+	return s
+}
+
+// OpenStream creates a new stream, and announces it to the peer with a
+// SYN_STREAM frame carrying headers. If the peer already has as many of our
+// streams open as it allows, this waits for one to close or fails with
+// ErrTooManyStreams, as set by Config.StreamLimitPolicy.
+func (s *Session) OpenStream(headers NameValuePairs) (*Stream, error) {
+	return s.OpenStreamWithPriority(headers, 0)
+}
+
+// OpenStreamWithPriority opens a stream like OpenStream, at a priority from 0,
+// the highest, to 7, the lowest. Data on higher priority streams is sent first.
+func (s *Session) OpenStreamWithPriority(headers NameValuePairs, priority uint8) (*Stream, error) {
+	if priority > lowestPriority {
+		return nil, ErrBadPriority
+	}
+	return s.openStream(headers, priority, 0, 0, nil)
+}
+
+// openStream opens a stream, or pushes one if it has an associated stream. With
+// FlagFin the stream is half-closed from the start. A non-zero slot names the
+// client certificate the stream is sent with.
+func (s *Session) openStream(headers NameValuePairs, priority, slot, flags uint8, associated *Stream) (*Stream, error) {
+	s.mu.Lock()
+	if err := s.waitForStreamLocked(); err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	if s.nextId > maxStreamId {
+		s.mu.Unlock()
+		return nil, ErrStreamIdsUsed
+	}
+	stream := newStream(s, s.nextId, headers)
+	stream.priority = priority
+	s.nextId += 2
+
+	frame := &SynStream{
+		Flags:    flags,
+		StreamId: stream.id,
+		Priority: priority,
+		Slot:     slot,
+		Headers:  headers,
+	}
+	if flags&FlagFin != 0 {
+		stream.localClosed = true
+	}
+	if associated != nil {
+		// A pushed stream only goes one way, with no reply
+		frame.Flags |= FlagUnidirectional
+		frame.AssociatedStreamId = associated.id
+		stream.associatedId = associated.id
+		stream.replied = true
+		stream.remoteClosed = true
+	}
+	s.addStreamLocked(stream)
+
+	// Queue the SYN_STREAM before letting go of the lock so frames reach the
+	// wire in increasing stream id order.
+	done := s.queueLocked(frame)
+	s.mu.Unlock()
+
+	if err := <-done; err != nil {
+		s.removeStream(stream.id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// waitForStreamLocked waits until the peer's limit allows another stream to be
+// opened.
+func (s *Session) waitForStreamLocked() error {
+	ticket := s.openTicket
+	s.openTicket++
+	defer func() {
+		s.openServed++
+		s.openCond.Broadcast()
+	}()
+
+	for {
+		switch {
+		case s.err != nil:
+			return s.err
+		case s.goAwayReceived:
+			return ErrGoAway
+		case s.drained != nil:
+			return ErrShutdown
+		case ticket == s.openServed && !s.atStreamLimitLocked():
+			return nil
+		case s.config.StreamLimitPolicy == StreamLimitFailFast:
+			return ErrTooManyStreams
+		}
+		s.openCond.Wait()
+	}
+}
+
+func (s *Session) atStreamLimitLocked() bool {
+	return s.peerMaxStreams >= 0 && s.localStreams >= s.peerMaxStreams
+}
+
+// available is true if a stream could be opened on the session right away.
+func (s *Session) available() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err == nil && !s.goAwayReceived && s.drained == nil &&
+		!s.atStreamLimitLocked()
+}
+
+// idle is true if the session has no open streams.
+func (s *Session) idle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams) == 0
+}
+
+// AcceptStream waits for the next stream opened by the peer.
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.closed:
+		return nil, s.Err()
+	}
+}
+
+// Ping sends the peer a PING, and returns how long it took to answer.
+func (s *Session) Ping(ctx context.Context) (time.Duration, error) {
+	s.mu.Lock()
+	id := s.nextPingId
+	s.nextPingId += 2
+	pong := make(chan struct{})
+	s.pings[id] = pong
+	s.queueLocked(&Ping{Id: id})
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.pings, id)
+		s.mu.Unlock()
+	}()
+
+	start := time.Now()
+	select {
+	case <-pong:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-s.closed:
+		return 0, s.Err()
+	}
+}
+
+// keepAlive pings the peer every KeepAliveInterval, closing the session if it
+// misses too many pings in a row.
+func (s *Session) keepAlive() {
+	interval := s.config.KeepAliveInterval
+	missed := 0
+	for {
+		select {
+		case <-time.After(interval):
+		case <-s.closed:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		_, err := s.Ping(ctx)
+		cancel()
+
+		switch {
+		case err == nil:
+			missed = 0
+		case err == context.DeadlineExceeded:
+			missed++
+			if missed >= s.config.MaxMissedPings {
+				s.closeWithError(ErrKeepAlive)
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Shutdown closes the session gracefully. It sends the peer a GOAWAY, after
+// which neither end may open new streams, then waits for the open streams to
+// finish before closing the connection. If ctx is done first, the session is
+// closed straight away with the streams left open failing.
+func (s *Session) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.drained == nil {
+		s.drained = make(chan struct{})
+		s.goAwaySent = s.queueLocked(&GoAway{
+			LastGoodStreamId: s.lastRemoteId,
+			StatusCode:       GoAwayOK,
+		})
+		s.openCond.Broadcast()
+		s.checkDrainedLocked()
+	}
+	drained, goAwaySent := s.drained, s.goAwaySent
+	s.mu.Unlock()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		s.closeWithError(ErrSessionClosed)
+		return ctx.Err()
+	case <-s.closed:
+		return s.shutdownErr()
+	}
+
+	// Make sure the GOAWAY, and the last frames of the streams, have gone
+	// before closing the connection under them
+	select {
+	case <-goAwaySent:
+	case <-ctx.Done():
+	case <-s.closed:
+		return s.shutdownErr()
+	}
+	select {
+	case <-s.flushed():
+	case <-ctx.Done():
+	case <-s.closed:
+		return s.shutdownErr()
+	}
+	s.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+// shutdownErr is the result of a Shutdown which found the session closed. That
+// the peer closed it first is no failure.
+func (s *Session) shutdownErr() error {
+	if err := s.Err(); err != ErrSessionClosed {
+		return err
+	}
+	return nil
+}
+
+// checkDrainedLocked closes drained if the session is shutting down and all of
+// its streams are done.
+func (s *Session) checkDrainedLocked() {
+	if s.drained == nil || len(s.streams) > 0 {
+		return
+	}
+	select {
+	case <-s.drained:
+	default:
+		close(s.drained)
+	}
+}
+
+// Close tears down the connection, failing any open streams.
+func (s *Session) Close() error {
+	s.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+// Err returns the reason the session has closed, or nil if it is still open.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Closed returns a channel which is closed once the session has ended.
+func (s *Session) Closed() <-chan struct{} {
+	return s.closed
+}
+
+func (s *Session) closeWithError(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*Stream)
+	s.localStreams, s.remoteStreams = 0, 0
+	s.writeCond.Broadcast()
+	s.openCond.Broadcast()
+	s.windowCond.Broadcast()
+	s.checkFlushedLocked()
+	s.mu.Unlock()
+
+	// Fail the streams first, so nobody who sees the session closed can still
+	// find one of its streams open
+	for _, stream := range streams {
+		stream.sessionClosed(err)
+	}
+	close(s.closed)
+	s.conn.Close()
+}
+
+// Version is the version of SPDY the session speaks.
+func (s *Session) Version() SpdyVersion {
+	return s.framer.Version
+}
+
+// flowControl is false for SPDY/2, which predates flow control windows.
+func (s *Session) flowControl() bool {
+	return s.framer.Version != Spdy2
+}
+
+// sessionFlowControl is true if the session has windows of its own as well as
+// those of its streams.
+func (s *Session) sessionFlowControl() bool {
+	return s.framer.Version == Spdy31
+}
+
+// reserveWindow waits for room in the session's send window, and takes up to
+// size bytes of it.
+func (s *Session) reserveWindow(size int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.sendWindow <= 0 && s.err == nil {
+		s.windowCond.Wait()
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	if size > int(s.sendWindow) {
+		size = int(s.sendWindow)
+	}
+	s.sendWindow -= int32(size)
+	return size, nil
+}
+
+// consumed hands n bytes of the session's receive window back to the peer once
+// enough has been read, or thrown away, to be worth a WINDOW_UPDATE.
+func (s *Session) consumed(n int) {
+	if !s.sessionFlowControl() || n == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unacked += int32(n)
+	if s.unacked < defaultInitialWindowSize/2 {
+		return
+	}
+	s.recvWindow += s.unacked
+	s.queueLocked(&WindowUpdate{
+		StreamId:        0,
+		DeltaWindowSize: uint32(s.unacked),
+	})
+	s.unacked = 0
+}
+
+// isLocalId is true for stream ids this end of the session would allocate.
+func (s *Session) isLocalId(id uint32) bool {
+	return (id%2 == 0) == s.server
+}
+
+func (s *Session) getStream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) addStreamLocked(stream *Stream) {
+	s.streams[stream.id] = stream
+	if s.isLocalId(stream.id) {
+		s.localStreams++
+	} else {
+		s.remoteStreams++
+	}
+}
+
+// removeStream forgets a stream, freeing its place under the concurrent stream
+// limit.
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.streams[id]; !ok {
+		return
+	}
+	delete(s.streams, id)
+	if s.isLocalId(id) {
+		s.localStreams--
+		s.openCond.Broadcast()
+	} else {
+		s.remoteStreams--
+	}
+	s.checkDrainedLocked()
+}
+
+// abortStream forgets a stream which has been reset, or which the peer will not
+// process. Any DATA still queued for it fails with err rather than following
+// the RST_STREAM onto the wire.
+func (s *Session) abortStream(id uint32, err error) {
+	s.removeStream(id)
+	s.mu.Lock()
+	dropped := s.writes.remove(id)
+	s.mu.Unlock()
+	for _, req := range dropped {
+		req.done <- err
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Writing
+
+// writeFrame writes a frame and waits for it to reach the connection.
+func (s *Session) writeFrame(frame Frame) error {
+	return <-s.queue(frame)
+}
+
+// writeStreamFrame writes a frame for a stream of the given priority, and
+// waits for it to reach the connection.
+func (s *Session) writeStreamFrame(frame Frame, priority uint8) error {
+	return <-s.schedule(frame, priority)
+}
+
+// schedule hands a frame for a stream of the given priority to the write loop
+// without waiting on it.
+func (s *Session) schedule(frame Frame, priority uint8) chan error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scheduleLocked(frame, priority)
+}
+
+// queue hands a frame to the write loop without waiting on it. The returned
+// channel yields the result of the write.
+func (s *Session) queue(frame Frame) chan error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queueLocked(frame)
+}
+
+func (s *Session) queueLocked(frame Frame) chan error {
+	return s.scheduleLocked(frame, lowestPriority)
+}
+
+func (s *Session) scheduleLocked(frame Frame, priority uint8) chan error {
+	done := make(chan error, 1)
+	if s.err != nil {
+		done <- s.err
+		return done
+	}
+	s.writes.push(&writeRequest{frame: frame, priority: priority, done: done})
+	s.writeCond.Signal()
+	return done
+}
+
+func (s *Session) writeLoop() {
+	for {
+		s.mu.Lock()
+		for s.writes.empty() && s.err == nil {
+			s.writeCond.Wait()
+		}
+		if s.err != nil {
+			writes := s.writes.drain()
+			err := s.err
+			s.mu.Unlock()
+			for _, req := range writes {
+				req.done <- err
+			}
+			return
+		}
+		req := s.writes.pop()
+		s.writing = true
+		s.mu.Unlock()
+
+		// A header block which breaks the rules is refused before any of it
+		// is written, so only fails its own frame
+		err := s.framer.Write(req.frame)
+		req.done <- err
+		var streamErr *StreamError
+		if err != nil && !errors.As(err, &streamErr) {
+			s.closeWithError(err)
+		}
+
+		s.mu.Lock()
+		s.writing = false
+		s.checkFlushedLocked()
+		s.mu.Unlock()
+	}
+}
+
+// flushed returns a channel which is closed once every frame queued so far has
+// been written, or the session has closed.
+func (s *Session) flushed() chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	flushed := make(chan struct{})
+	s.flushes = append(s.flushes, flushed)
+	s.checkFlushedLocked()
+	return flushed
+}
+
+// checkFlushedLocked wakes anyone waiting in flushed if the write loop has
+// nothing left to write.
+func (s *Session) checkFlushedLocked() {
+	if s.err == nil && (s.writing || !s.writes.empty()) {
+		return
+	}
+	for _, flushed := range s.flushes {
+		close(flushed)
+	}
+	s.flushes = nil
+}
+
+// ----------------------------------------------------------------------------
+// Reading
+
+func (s *Session) readLoop() {
+	for {
+		frame, err := s.framer.Read()
+		if err != nil {
+			var streamErr *StreamError
+			if errors.As(err, &streamErr) {
+				s.resetStream(streamErr)
+				continue
+			}
+			s.fail(err)
+			return
+		}
+
+		if err = s.handleFrame(frame); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+// fail ends the session, letting the peer know why if it was their fault.
+func (s *Session) fail(err error) {
+	var sessionErr *SessionError
+	if errors.As(err, &sessionErr) {
+		s.mu.Lock()
+		sessionErr.LastGoodStreamId = s.lastRemoteId
+		s.mu.Unlock()
+		s.writeFrame(sessionErr.Frame())
+	} else if err == io.EOF {
+		err = ErrSessionClosed
+	}
+	s.closeWithError(err)
+}
+
+// resetStream answers a stream error with a RST_STREAM, and fails the stream
+// locally if it is open.
+func (s *Session) resetStream(err *StreamError) {
+	s.queue(err.Frame())
+	if stream := s.getStream(err.StreamId); stream != nil {
+		stream.closeWithError(err)
+		s.abortStream(err.StreamId, err)
+	}
+}
+
+func (s *Session) handleFrame(frame Frame) error {
+	switch frame := frame.(type) {
+	case *SynStream:
+		return s.handleSynStream(frame)
+	case *SynReply:
+		return s.handleSynReply(frame)
+	case *RstStream:
+		return s.handleRstStream(frame)
+	case *Headers:
+		return s.handleHeaders(frame)
+	case *DataFrame:
+		return s.handleData(frame)
+	case *WindowUpdate:
+		return s.handleWindowUpdate(frame)
+	case *Settings:
+		return s.handleSettings(frame)
+	case *Ping:
+		return s.handlePing(frame)
+	case *GoAway:
+		return s.handleGoAway(frame)
+	case *Credential:
+		return s.handleCredential(frame)
+	}
+	return nil
+}
+
+func (s *Session) handleSynStream(frame *SynStream) error {
+	id := frame.StreamId
+	if id == 0 || s.isLocalId(id) {
+		return sessionError(GoAwayProtocolError,
+			"peer opened stream %d from our id space", id)
+	}
+
+	var associated *Stream
+	var streamErr *StreamError
+	if frame.AssociatedStreamId != 0 {
+		associated, streamErr = s.checkPush(frame)
+	}
+	// Only SPDY/3 has credentials; later versions leave the slot unused
+	var chain []*x509.Certificate
+	if frame.Slot != 0 && streamErr == nil && s.framer.Version == Spdy3 {
+		chain, streamErr = s.checkCredential(frame)
+	}
+
+	s.mu.Lock()
+	if _, ok := s.streams[id]; ok {
+		s.mu.Unlock()
+		err := protocolError("stream %d opened twice", id)
+		err.StreamId = id
+		s.resetStream(err)
+		return nil
+	}
+	if id <= s.lastRemoteId {
+		s.mu.Unlock()
+		return sessionError(GoAwayProtocolError,
+			"stream %d opened after stream %d", id, s.lastRemoteId)
+	}
+	s.lastRemoteId = id
+
+	if streamErr != nil {
+		s.mu.Unlock()
+		s.resetStream(streamErr)
+		return nil
+	}
+
+	if s.drained != nil {
+		s.mu.Unlock()
+		s.resetStream(&StreamError{
+			StreamId:   id,
+			StatusCode: RefusedStream,
+			Reason:     "session is shutting down",
+		})
+		return nil
+	}
+
+	limit := s.config.MaxConcurrentStreams
+	if limit > 0 && s.remoteStreams >= limit {
+		s.mu.Unlock()
+		s.resetStream(&StreamError{
+			StreamId:   id,
+			StatusCode: RefusedStream,
+			Reason:     "too many concurrent streams",
+		})
+		return nil
+	}
+
+	stream := newStream(s, id, frame.Headers)
+	stream.priority = frame.Priority
+	if frame.Flags&FlagFin != 0 {
+		stream.remoteClosed = true
+	}
+	if frame.Flags&FlagUnidirectional != 0 {
+		stream.localClosed = true
+	}
+	stream.associatedId = frame.AssociatedStreamId
+	stream.credential = chain
+	s.addStreamLocked(stream)
+	s.mu.Unlock()
+
+	if associated != nil && s.config.PushHandler != nil {
+		if status := s.config.PushHandler(associated, stream); status != 0 {
+			s.resetStream(stream.errorf(status, "push rejected"))
+		}
+		return nil
+	}
+
+	select {
+	case s.accept <- stream:
+	default:
+		s.resetStream(&StreamError{
+			StreamId:   id,
+			StatusCode: RefusedStream,
+			Reason:     "accept backlog is full",
+		})
+	}
+	return nil
+}
+
+// checkPush finds the stream a pushed stream is associated with. Only servers
+// may push, and only on a stream the client opened which the server has not yet
+// finished.
+func (s *Session) checkPush(frame *SynStream) (*Stream, *StreamError) {
+	fail := func(status RstStreamStatus, reason string) (*Stream, *StreamError) {
+		return nil, &StreamError{
+			StreamId:   frame.StreamId,
+			StatusCode: status,
+			Reason:     reason,
+		}
+	}
+
+	if s.server {
+		return fail(ProtocolError, "client pushed a stream")
+	}
+	if frame.Flags&FlagUnidirectional == 0 {
+		return fail(ProtocolError, "pushed stream is not unidirectional")
+	}
+	associated := s.getStream(frame.AssociatedStreamId)
+	if associated == nil || !s.isLocalId(associated.id) {
+		return fail(InvalidStream, "pushed stream has no associated stream")
+	}
+
+	associated.mu.Lock()
+	defer associated.mu.Unlock()
+	if associated.remoteClosed || associated.err != nil {
+		return fail(InvalidStream, "pushed after its associated stream closed")
+	}
+	return associated, nil
+}
+
+func (s *Session) handleSynReply(frame *SynReply) error {
+	stream := s.getStream(frame.StreamId)
+	if stream == nil {
+		s.resetStream(&StreamError{
+			StreamId:   frame.StreamId,
+			StatusCode: InvalidStream,
+			Reason:     "SYN_REPLY for unknown stream",
+		})
+		return nil
+	}
+	if err := stream.handleReply(frame); err != nil {
+		s.resetStream(err)
+	}
+	return nil
+}
+
+func (s *Session) handleRstStream(frame *RstStream) error {
+	if stream := s.getStream(frame.StreamId); stream != nil {
+		err := &StreamError{
+			StreamId:   frame.StreamId,
+			StatusCode: frame.StatusCode,
+			Reason:     "reset by peer",
+		}
+		stream.closeWithError(err)
+		s.abortStream(frame.StreamId, err)
+	}
+	return nil
+}
+
+func (s *Session) handleHeaders(frame *Headers) error {
+	stream := s.getStream(frame.StreamId)
+	if stream == nil {
+		s.resetStream(&StreamError{
+			StreamId:   frame.StreamId,
+			StatusCode: InvalidStream,
+			Reason:     "HEADERS for unknown stream",
+		})
+		return nil
+	}
+	if err := stream.handleHeaders(frame); err != nil {
+		s.resetStream(err)
+	}
+	return nil
+}
+
+func (s *Session) handleData(frame *DataFrame) error {
+	if s.sessionFlowControl() {
+		s.mu.Lock()
+		if len(frame.Data) > int(s.recvWindow) {
+			s.mu.Unlock()
+			return sessionError(GoAwayProtocolError,
+				"DATA on stream %d overran the session receive window", frame.StreamId)
+		}
+		s.recvWindow -= int32(len(frame.Data))
+		s.mu.Unlock()
+	}
+
+	// Data no stream takes still counts against the session window, so is
+	// handed straight back.
+	stream := s.getStream(frame.StreamId)
+	if stream == nil {
+		s.consumed(len(frame.Data))
+		s.resetStream(&StreamError{
+			StreamId:   frame.StreamId,
+			StatusCode: InvalidStream,
+			Reason:     "DATA for unknown stream",
+		})
+		return nil
+	}
+	if err := stream.handleData(frame); err != nil {
+		s.consumed(len(frame.Data))
+		s.resetStream(err)
+	}
+	return nil
+}
+
+func (s *Session) handleWindowUpdate(frame *WindowUpdate) error {
+	if !s.flowControl() {
+		return nil
+	}
+	if frame.StreamId == 0 {
+		return s.handleSessionWindowUpdate(frame)
+	}
+
+	// The update may have crossed paths with the stream closing, in which case
+	// there is nothing left to do with it.
+	if stream := s.getStream(frame.StreamId); stream != nil {
+		if err := stream.handleWindowUpdate(frame); err != nil {
+			s.resetStream(err)
+		}
+	}
+	return nil
+}
+
+// handleSessionWindowUpdate opens the session's send window. Before SPDY/3.1
+// there is no such window, and the frame is ignored.
+func (s *Session) handleSessionWindowUpdate(frame *WindowUpdate) error {
+	if !s.sessionFlowControl() {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if int64(s.sendWindow)+int64(frame.DeltaWindowSize) > maxWindowSize {
+		return sessionError(GoAwayProtocolError, "session send window overflowed")
+	}
+	s.sendWindow += int32(frame.DeltaWindowSize)
+	s.windowCond.Broadcast()
+	return nil
+}
+
+func (s *Session) handleSettings(frame *Settings) error {
+	if size, ok := peerValue(frame, SettingsInitialWindowSize); ok && s.flowControl() {
+		if size < 0 {
+			return sessionError(GoAwayProtocolError,
+				"negative initial window size %d", size)
+		}
+		s.setInitialSendWindow(size)
+	}
+	if max, ok := peerValue(frame, SettingsMaxConcurrentStreams); ok {
+		if max < 0 {
+			return sessionError(GoAwayProtocolError,
+				"negative max concurrent streams %d", max)
+		}
+		s.setPeerMaxStreams(int(max))
+	}
+	if size, ok := peerValue(frame, SettingsClientCertificateVectorSize); ok && !s.server {
+		if size < 0 {
+			return sessionError(GoAwayProtocolError,
+				"negative client certificate vector size %d", size)
+		}
+		s.mu.Lock()
+		s.peerVectorSize = int(size)
+		s.mu.Unlock()
+	}
+
+	s.persistSettings(frame)
+	return nil
+}
+
+// peerValue returns the value the peer gave a setting of its own. Settings
+// flagged as persisted are ours, echoed back by a client, and are skipped.
+func peerValue(frame *Settings, id SettingsId) (int32, bool) {
+	for _, setting := range frame.Settings {
+		if setting.Id == id && setting.Flags&FlagSettingsPersisted == 0 {
+			return setting.Value, true
+		}
+	}
+	return 0, false
+}
+
+// handlePing answers pings sent by the peer, and passes answers to our own
+// pings on to whoever is waiting for them. An answer to a ping we have given up
+// on is dropped.
+func (s *Session) handlePing(frame *Ping) error {
+	if !s.isLocalId(frame.Id) {
+		s.queue(&Ping{Id: frame.Id})
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pong, ok := s.pings[frame.Id]; ok {
+		close(pong)
+		delete(s.pings, frame.Id)
+	}
+	return nil
+}
+
+// handleGoAway stops any more streams being opened, and fails those the peer
+// will not process with ErrGoAway so they can be retried elsewhere. Streams up
+// to LastGoodStreamId carry on as normal.
+func (s *Session) handleGoAway(frame *GoAway) error {
+	s.mu.Lock()
+	if !s.goAwayReceived {
+		s.goAwayReceived = true
+		close(s.goneAway)
+	}
+	s.openCond.Broadcast()
+	var unprocessed []*Stream
+	for id, stream := range s.streams {
+		if s.isLocalId(id) && id > frame.LastGoodStreamId {
+			unprocessed = append(unprocessed, stream)
+		}
+	}
+	s.mu.Unlock()
+
+	// Each stream fails before it is removed, so a session which shuts down
+	// once it is drained cannot fail it first with another error
+	for _, stream := range unprocessed {
+		stream.closeWithError(ErrGoAway)
+		s.abortStream(stream.id, ErrGoAway)
+	}
+	return nil
+}
+
+// usesSettingsStore is true for clients configured to persist settings.
+func (s *Session) usesSettingsStore() bool {
+	return !s.server && s.config.SettingsStore != nil && s.config.Origin != ""
+}
+
+// sendInitialSettings tells the peer our own limits, along with any settings
+// persisted for this origin, ahead of any other frame. The persisted settings
+// hold the server's values rather than ours, and an id may only appear once in
+// a frame, so they are replayed in a frame of their own.
+func (s *Session) sendInitialSettings() {
+	// A store which cannot be read is no different to an empty one
+	if s.usesSettingsStore() {
+		persisted, _ := s.config.SettingsStore.Get(s.config.Origin)
+		replay := new(Settings)
+		for _, setting := range persisted {
+			replay.Set(setting.Id, setting.Value, FlagSettingsPersisted)
+		}
+		if len(replay.Settings) > 0 {
+			s.queue(replay)
+		}
+	}
+
+	frame := new(Settings)
+	if max := s.config.MaxConcurrentStreams; max > 0 {
+		frame.Set(SettingsMaxConcurrentStreams, int32(max), 0)
+	}
+	if size := s.config.CredentialVectorSize; size > 0 && s.server {
+		frame.Set(SettingsClientCertificateVectorSize, int32(size), 0)
+	}
+	if len(frame.Settings) > 0 {
+		s.queue(frame)
+	}
+}
+
+// persistSettings updates the settings store from a SETTINGS frame sent by the
+// server. Failing to persist a setting does not affect the session.
+func (s *Session) persistSettings(frame *Settings) {
+	if !s.usesSettingsStore() {
+		return
+	}
+	store, origin := s.config.SettingsStore, s.config.Origin
+
+	if frame.Flags&FlagSettingsClearSettings != 0 {
+		store.Clear(origin)
+	}
+
+	var updates []*Setting
+	for _, setting := range frame.Settings {
+		if setting.Flags&FlagSettingsPersistValue != 0 {
+			updates = append(updates, setting)
+		}
+	}
+	if len(updates) == 0 {
+		return
+	}
+
+	persisted, err := store.Get(origin)
+	if err != nil {
+		return
+	}
+	store.Set(origin, mergeSettings(persisted, updates))
+}
+
+// setPeerMaxStreams changes how many streams the peer will let us have open,
+// waking any OpenStream calls which may now go ahead.
+func (s *Session) setPeerMaxStreams(max int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peerMaxStreams = max
+	s.openCond.Broadcast()
+}
+
+// setInitialSendWindow changes the window new streams start with, and moves the
+// window of every open stream by the same amount. This may leave streams with
+// a negative window, which they must wait out before sending again.
+func (s *Session) setInitialSendWindow(size int32) {
+	s.mu.Lock()
+	delta := size - s.initialSendWindow
+	s.initialSendWindow = size
+	streams := make([]*Stream, 0, len(s.streams))
+	for _, stream := range s.streams {
+		streams = append(streams, stream)
+	}
+	s.mu.Unlock()
+
+	for _, stream := range streams {
+		if err := stream.adjustSendWindow(delta); err != nil {
+			s.resetStream(err)
+		}
+	}
+}
@@ -0,0 +1,666 @@
+package spdy3
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// newSessionPair connects a client and server session over an in-memory pipe.
+func newSessionPair(clientConfig, serverConfig *Config) (client, server *Session) {
+	clientConn, serverConn := net.Pipe()
+	client = NewSession(clientConn, false, clientConfig)
+	server = NewSession(serverConn, true, serverConfig)
+	return
+}
+
+// newPeer connects a session to a bare Framer, for tests which need to control
+// exactly which frames the other end sends.
+func newPeer(server bool, config *Config) (*Session, *Framer) {
+	conn, peerConn := net.Pipe()
+	return NewSession(conn, server, config), NewFramer(config.withDefaults().Version, peerConn)
+}
+
+// readFrame reads the next frame from a peer in the background, so tests can
+// still fail if nothing arrives.
+func readFrame(framer *Framer) Frame {
+	frames := make(chan Frame, 1)
+	go func() {
+		defer GinkgoRecover()
+		frame, err := framer.Read()
+		Expect(err).To(BeNil())
+		frames <- frame
+	}()
+	var frame Frame
+	Eventually(frames).Should(Receive(&frame))
+	return frame
+}
+
+var _ = Describe("Session", func() {
+	var client, server *Session
+
+	BeforeEach(func() {
+		client, server = newSessionPair(nil, nil)
+	})
+
+	AfterEach(func() {
+		client.Close()
+		server.Close()
+	})
+
+	It("should fail only the stream whose headers are bad", func() {
+		_, err := client.OpenStream(NameValuePairs{"Bad": {"header"}})
+		Expect(err).To(BeAssignableToTypeOf(&StreamError{}))
+		Expect(client.Err()).To(BeNil())
+
+		stream, err := client.OpenStream(NameValuePairs{"good": {"header"}})
+		Expect(err).To(BeNil())
+		accepted, err := server.AcceptStream()
+		Expect(err).To(BeNil())
+		Expect(accepted.Id()).To(Equal(stream.Id()))
+		Expect(accepted.Headers()).To(Equal(NameValuePairs{"good": {"header"}}))
+	})
+
+	It("should allocate odd ids to the client", func() {
+		for _, id := range []uint32{1, 3, 5} {
+			stream, err := client.OpenStream(NameValuePairs{"n": {"v"}})
+			Expect(err).To(BeNil())
+			Expect(stream.Id()).To(Equal(id))
+
+			accepted, err := server.AcceptStream()
+			Expect(err).To(BeNil())
+			Expect(accepted.Id()).To(Equal(id))
+			Expect(accepted.headers).To(Equal(NameValuePairs{"n": {"v"}}))
+		}
+	})
+
+	It("should allocate even ids to the server", func() {
+		stream, err := server.OpenStream(NameValuePairs{})
+		Expect(err).To(BeNil())
+		Expect(stream.Id()).To(Equal(uint32(2)))
+
+		accepted, err := client.AcceptStream()
+		Expect(err).To(BeNil())
+		Expect(accepted.Id()).To(Equal(uint32(2)))
+	})
+
+	It("should route replies to their stream", func() {
+		stream1, _ := client.OpenStream(NameValuePairs{})
+		stream3, _ := client.OpenStream(NameValuePairs{})
+		server.AcceptStream()
+		accepted3, _ := server.AcceptStream()
+
+		Expect(accepted3.Reply(NameValuePairs{":status": {"200"}})).To(Succeed())
+		Expect(accepted3.Reply(NameValuePairs{})).To(Equal(ErrAlreadyReplied))
+
+		Eventually(func() NameValuePairs {
+			stream3.mu.Lock()
+			defer stream3.mu.Unlock()
+			return stream3.replyHeaders
+		}).Should(Equal(NameValuePairs{":status": {"200"}}))
+
+		stream1.mu.Lock()
+		defer stream1.mu.Unlock()
+		Expect(stream1.replied).To(BeFalse())
+	})
+
+	It("should fail streams and accepts when the connection goes", func() {
+		stream, _ := client.OpenStream(NameValuePairs{})
+		server.AcceptStream()
+		server.Close()
+
+		_, err := client.AcceptStream()
+		Expect(err).To(Equal(ErrSessionClosed))
+
+		stream.mu.Lock()
+		defer stream.mu.Unlock()
+		Expect(stream.err).To(Equal(ErrSessionClosed))
+
+		_, err = client.OpenStream(NameValuePairs{})
+		Expect(err).To(Equal(ErrSessionClosed))
+	})
+})
+
+var _ = Describe("Session routing", func() {
+	var (
+		session *Session
+		peer    *Framer
+	)
+
+	BeforeEach(func() {
+		session, peer = newPeer(false, nil)
+	})
+
+	AfterEach(func() {
+		session.Close()
+	})
+
+	It("should route data to its stream", func() {
+		go session.OpenStream(NameValuePairs{})
+		Expect(readFrame(peer)).To(BeAssignableToTypeOf(&SynStream{}))
+		stream := session.getStream(1)
+
+		Expect(peer.Write(&SynReply{StreamId: 1, Headers: NameValuePairs{}})).To(Succeed())
+		Expect(peer.Write(&DataFrame{StreamId: 1, Data: []byte("abc")})).To(Succeed())
+		Expect(peer.Write(&DataFrame{
+			StreamId: 1,
+			Flags:    FlagFin,
+			Data:     []byte("def"),
+		})).To(Succeed())
+
+		Eventually(func() bool {
+			stream.mu.Lock()
+			defer stream.mu.Unlock()
+			return stream.remoteClosed
+		}).Should(BeTrue())
+		Expect(stream.buf.String()).To(Equal("abcdef"))
+	})
+
+	It("should fail a stream the peer resets", func() {
+		go session.OpenStream(NameValuePairs{})
+		readFrame(peer)
+		stream := session.getStream(1)
+
+		Expect(peer.Write(&RstStream{StreamId: 1, StatusCode: Cancel})).To(Succeed())
+		Eventually(func() error {
+			stream.mu.Lock()
+			defer stream.mu.Unlock()
+			return stream.err
+		}).Should(BeAssignableToTypeOf(&StreamError{}))
+		Expect(stream.err.(*StreamError).StatusCode).To(Equal(Cancel))
+		Eventually(func() *Stream { return session.getStream(1) }).Should(BeNil())
+	})
+
+	It("should reset data for unknown streams", func() {
+		Expect(peer.Write(&DataFrame{StreamId: 9, Data: []byte("?")})).To(Succeed())
+		Expect(readFrame(peer)).To(Equal(&RstStream{
+			StreamId:   9,
+			StatusCode: InvalidStream,
+		}))
+	})
+
+	It("should accept streams from the peer", func() {
+		Expect(peer.Write(&SynStream{
+			StreamId: 2,
+			Flags:    FlagFin,
+			Priority: 3,
+			Headers:  NameValuePairs{"a": {"b"}},
+		})).To(Succeed())
+
+		stream, err := session.AcceptStream()
+		Expect(err).To(BeNil())
+		Expect(stream.Id()).To(Equal(uint32(2)))
+		Expect(stream.priority).To(Equal(uint8(3)))
+		Expect(stream.remoteClosed).To(BeTrue())
+	})
+
+	It("should refuse streams opened from its own id space", func() {
+		Expect(peer.Write(&SynStream{StreamId: 1, Headers: NameValuePairs{}})).To(Succeed())
+		Expect(readFrame(peer)).To(Equal(&GoAway{
+			StatusCode: GoAwayProtocolError,
+		}))
+		Eventually(session.Closed()).Should(BeClosed())
+	})
+
+	It("should refuse a second SYN_REPLY", func() {
+		go session.OpenStream(NameValuePairs{})
+		readFrame(peer)
+
+		Expect(peer.Write(&SynReply{StreamId: 1, Headers: NameValuePairs{}})).To(Succeed())
+		Expect(peer.Write(&SynReply{StreamId: 1, Headers: NameValuePairs{}})).To(Succeed())
+		Expect(readFrame(peer)).To(Equal(&RstStream{
+			StreamId:   1,
+			StatusCode: StreamInUse,
+		}))
+	})
+})
+
+var _ = Describe("Concurrent stream limits", func() {
+	var (
+		session *Session
+		peer    *Framer
+		config  *Config
+	)
+
+	BeforeEach(func() {
+		config = &Config{}
+	})
+
+	JustBeforeEach(func() {
+		session, peer = newPeer(false, config)
+	})
+
+	AfterEach(func() {
+		session.Close()
+	})
+
+	// limitStreams has the peer allow the session max streams at once.
+	limitStreams := func(max int32) {
+		settings := new(Settings)
+		settings.Set(SettingsMaxConcurrentStreams, max, 0)
+		Expect(peer.Write(settings)).To(Succeed())
+		Eventually(func() int {
+			session.mu.Lock()
+			defer session.mu.Unlock()
+			return session.peerMaxStreams
+		}).Should(Equal(int(max)))
+	}
+
+	Context("with a limit of our own", func() {
+		BeforeEach(func() {
+			config.MaxConcurrentStreams = 1
+		})
+
+		It("should advertise it", func() {
+			frame := readFrame(peer).(*Settings)
+			max, ok := frame.Value(SettingsMaxConcurrentStreams)
+			Expect(ok).To(BeTrue())
+			Expect(max).To(Equal(int32(1)))
+		})
+
+		It("should refuse streams beyond it", func() {
+			readFrame(peer)
+			Expect(peer.Write(&SynStream{StreamId: 2, Headers: NameValuePairs{}})).To(Succeed())
+			Expect(peer.Write(&SynStream{StreamId: 4, Headers: NameValuePairs{}})).To(Succeed())
+			Expect(readFrame(peer)).To(Equal(&RstStream{
+				StreamId:   4,
+				StatusCode: RefusedStream,
+			}))
+
+			stream, err := session.AcceptStream()
+			Expect(err).To(BeNil())
+			go stream.Reset(Cancel)
+			readFrame(peer)
+
+			Expect(peer.Write(&SynStream{StreamId: 6, Headers: NameValuePairs{}})).To(Succeed())
+			stream, err = session.AcceptStream()
+			Expect(err).To(BeNil())
+			Expect(stream.Id()).To(Equal(uint32(6)))
+		})
+	})
+
+	It("should wait for a stream to close once the peer's limit is reached", func() {
+		limitStreams(1)
+		go session.OpenStream(NameValuePairs{})
+		Expect(readFrame(peer)).To(BeAssignableToTypeOf(&SynStream{}))
+
+		opened := make(chan *Stream, 1)
+		go func() {
+			stream, _ := session.OpenStream(NameValuePairs{})
+			opened <- stream
+		}()
+		Consistently(opened).ShouldNot(Receive())
+
+		Expect(peer.Write(&RstStream{StreamId: 1, StatusCode: Cancel})).To(Succeed())
+		Expect(readFrame(peer)).To(BeAssignableToTypeOf(&SynStream{}))
+		var stream *Stream
+		Eventually(opened).Should(Receive(&stream))
+		Expect(stream.Id()).To(Equal(uint32(3)))
+	})
+
+	It("should let waiting streams go when the peer raises its limit", func() {
+		limitStreams(0)
+
+		opened := make(chan *Stream, 1)
+		go func() {
+			stream, _ := session.OpenStream(NameValuePairs{})
+			opened <- stream
+		}()
+		Consistently(opened).ShouldNot(Receive())
+
+		limitStreams(1)
+		Expect(readFrame(peer)).To(BeAssignableToTypeOf(&SynStream{}))
+		Eventually(opened).Should(Receive())
+	})
+
+	It("should fail waiting streams when the session closes", func() {
+		limitStreams(0)
+
+		errs := make(chan error, 1)
+		go func() {
+			_, err := session.OpenStream(NameValuePairs{})
+			errs <- err
+		}()
+		Consistently(errs).ShouldNot(Receive())
+
+		session.Close()
+		Eventually(errs).Should(Receive(Equal(ErrSessionClosed)))
+	})
+
+	Context("failing fast", func() {
+		BeforeEach(func() {
+			config.StreamLimitPolicy = StreamLimitFailFast
+		})
+
+		It("should not wait for the peer's limit", func() {
+			limitStreams(1)
+			go session.OpenStream(NameValuePairs{})
+			readFrame(peer)
+			Eventually(func() int {
+				session.mu.Lock()
+				defer session.mu.Unlock()
+				return session.localStreams
+			}).Should(Equal(1))
+
+			_, err := session.OpenStream(NameValuePairs{})
+			Expect(err).To(Equal(ErrTooManyStreams))
+		})
+	})
+})
+
+var _ = Describe("Pings", func() {
+	var (
+		session *Session
+		peer    *Framer
+		config  *Config
+	)
+
+	BeforeEach(func() {
+		config = nil
+	})
+
+	JustBeforeEach(func() {
+		session, peer = newPeer(false, config)
+	})
+
+	AfterEach(func() {
+		session.Close()
+	})
+
+	It("should answer pings from the peer", func() {
+		Expect(peer.Write(&Ping{Id: 2})).To(Succeed())
+		Expect(readFrame(peer)).To(Equal(&Ping{Id: 2}))
+	})
+
+	It("should measure the time taken to answer its own pings", func() {
+		rtts := make(chan time.Duration, 1)
+		go func() {
+			defer GinkgoRecover()
+			rtt, err := session.Ping(context.Background())
+			Expect(err).To(BeNil())
+			rtts <- rtt
+		}()
+
+		Expect(readFrame(peer)).To(Equal(&Ping{Id: 1}))
+		time.Sleep(10 * time.Millisecond)
+		Expect(peer.Write(&Ping{Id: 1})).To(Succeed())
+
+		var rtt time.Duration
+		Eventually(rtts).Should(Receive(&rtt))
+		Expect(rtt).To(BeNumerically(">=", 10*time.Millisecond))
+	})
+
+	It("should give up on a ping when its context is done", func() {
+		go readFrame(peer)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := session.Ping(ctx)
+		Expect(err).To(Equal(context.DeadlineExceeded))
+	})
+
+	It("should ping between sessions", func() {
+		client, server := newSessionPair(nil, nil)
+		defer client.Close()
+		defer server.Close()
+
+		_, err := client.Ping(context.Background())
+		Expect(err).To(BeNil())
+		_, err = server.Ping(context.Background())
+		Expect(err).To(BeNil())
+	})
+
+	Context("with keepalive", func() {
+		BeforeEach(func() {
+			config = &Config{
+				KeepAliveInterval: 10 * time.Millisecond,
+				MaxMissedPings:    2,
+			}
+		})
+
+		It("should keep a session open while the peer answers", func() {
+			peer := peer
+			go func() {
+				for {
+					frame, err := peer.Read()
+					if err != nil {
+						return
+					}
+					peer.Write(frame)
+				}
+			}()
+			Consistently(session.Closed(), 100*time.Millisecond).ShouldNot(BeClosed())
+		})
+
+		It("should close a session once the peer stops answering", func() {
+			peer := peer
+			go func() {
+				for {
+					if _, err := peer.Read(); err != nil {
+						return
+					}
+				}
+			}()
+			Eventually(session.Closed()).Should(BeClosed())
+			Expect(session.Err()).To(Equal(ErrKeepAlive))
+		})
+	})
+})
+
+var _ = Describe("Shutdown", func() {
+	var (
+		session *Session
+		peer    *Framer
+	)
+
+	BeforeEach(func() {
+		session, peer = newPeer(true, nil)
+	})
+
+	AfterEach(func() {
+		session.Close()
+	})
+
+	// shutdown starts shutting the session down in the background, returning
+	// the channel its result will be sent on.
+	shutdown := func(ctx context.Context) chan error {
+		errs := make(chan error, 1)
+		go func() {
+			errs <- session.Shutdown(ctx)
+		}()
+		return errs
+	}
+
+	It("should close straight away with no streams open", func() {
+		errs := shutdown(context.Background())
+		Expect(readFrame(peer)).To(Equal(&GoAway{StatusCode: GoAwayOK}))
+		Eventually(errs).Should(Receive(BeNil()))
+		Expect(session.Closed()).To(BeClosed())
+	})
+
+	It("should let open streams finish", func() {
+		Expect(peer.Write(&SynStream{StreamId: 1, Headers: NameValuePairs{}})).To(Succeed())
+		stream, err := session.AcceptStream()
+		Expect(err).To(BeNil())
+
+		errs := shutdown(context.Background())
+		Expect(readFrame(peer)).To(Equal(&GoAway{
+			LastGoodStreamId: 1,
+			StatusCode:       GoAwayOK,
+		}))
+
+		Expect(peer.Write(&SynStream{StreamId: 3, Headers: NameValuePairs{}})).To(Succeed())
+		Expect(readFrame(peer)).To(Equal(&RstStream{
+			StreamId:   3,
+			StatusCode: RefusedStream,
+		}))
+		Consistently(session.Closed()).ShouldNot(BeClosed())
+
+		go stream.CloseWrite()
+		Expect(readFrame(peer)).To(BeAssignableToTypeOf(&SynReply{}))
+		Expect(peer.Write(&DataFrame{StreamId: 1, Flags: FlagFin})).To(Succeed())
+		Eventually(errs).Should(Receive(BeNil()))
+		Expect(session.Closed()).To(BeClosed())
+	})
+
+	It("should send the last data and FIN of streams finishing as it shuts down", func() {
+		for i := 0; i < 200; i++ {
+			client, server := newSessionPair(nil, nil)
+			stream, err := client.OpenStream(NameValuePairs{":path": {"/"}})
+			Expect(err).To(BeNil())
+			Expect(stream.CloseWrite()).To(Succeed())
+			accepted, err := server.AcceptStream()
+			Expect(err).To(BeNil())
+
+			go func() {
+				accepted.Write([]byte("hello"))
+				accepted.CloseWrite()
+			}()
+			go server.Shutdown(context.Background())
+
+			data, err := ioutil.ReadAll(stream)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte("hello")))
+			client.Close()
+			server.Close()
+		}
+	})
+
+	It("should close when its context is done", func() {
+		Expect(peer.Write(&SynStream{StreamId: 1, Headers: NameValuePairs{}})).To(Succeed())
+		session.AcceptStream()
+		ctx, cancel := context.WithCancel(context.Background())
+		errs := shutdown(ctx)
+		readFrame(peer)
+		Consistently(errs).ShouldNot(Receive())
+
+		cancel()
+		Eventually(errs).Should(Receive(Equal(context.Canceled)))
+		Expect(session.Closed()).To(BeClosed())
+	})
+
+	It("should not open streams while shutting down", func() {
+		Expect(peer.Write(&SynStream{StreamId: 1, Headers: NameValuePairs{}})).To(Succeed())
+		session.AcceptStream()
+		shutdown(context.Background())
+		readFrame(peer)
+
+		_, err := session.OpenStream(NameValuePairs{})
+		Expect(err).To(Equal(ErrShutdown))
+	})
+})
+
+var _ = Describe("Version mismatches", func() {
+	var (
+		session *Session
+		peer    *Framer
+	)
+
+	BeforeEach(func() {
+		session, peer = newPeer(true, nil)
+	})
+
+	AfterEach(func() {
+		session.Close()
+	})
+
+	It("should reset streams opened with another version", func() {
+		// Compress the header block with the peer's own context, so the
+		// session has to decompress it to stay in step
+		buf := new(bytes.Buffer)
+		mismatched := &Framer{Version: Spdy3, rw: buf, compressor: peer.compressor}
+		Expect(mismatched.Write(&SynStream{
+			StreamId: 1,
+			Headers:  NameValuePairs{":path": {"/"}},
+		})).To(Succeed())
+		binary.BigEndian.PutUint16(buf.Bytes(), 0x8000|2)
+		_, err := peer.rw.Write(buf.Bytes())
+		Expect(err).To(BeNil())
+		Expect(readFrame(peer)).To(Equal(&RstStream{
+			StreamId:   1,
+			StatusCode: UnsupportedVersion,
+		}))
+
+		Expect(peer.Write(&SynStream{
+			StreamId: 3,
+			Headers:  NameValuePairs{":path": {"/next"}},
+		})).To(Succeed())
+		stream, err := session.AcceptStream()
+		Expect(err).To(BeNil())
+		Expect(stream.Headers()).To(Equal(NameValuePairs{":path": {"/next"}}))
+	})
+
+	It("should end the session when a stream of another version cannot be decompressed", func() {
+		Expect(NewFramer(Spdy2, peer.rw).Write(&SynStream{
+			StreamId: 1,
+			Headers:  NameValuePairs{":path": {"/"}},
+		})).To(Succeed())
+
+		frame := readFrame(peer).(*GoAway)
+		Expect(frame.StatusCode).To(Equal(GoAwayProtocolError))
+		Eventually(session.Closed()).Should(BeClosed())
+	})
+
+	It("should end the session on any other frame with another version", func() {
+		NewHeaderWord(true, SpdyVersion(4), PingType).Write(peer.rw)
+		NewFlagLenWord(0, 4).Write(peer.rw)
+		writeWord(peer.rw, 1)
+
+		frame := readFrame(peer).(*GoAway)
+		Expect(frame.StatusCode).To(Equal(GoAwayProtocolError))
+		Eventually(session.Closed()).Should(BeClosed())
+		Expect(session.Err()).To(BeAssignableToTypeOf(&VersionError{}))
+	})
+})
+
+var _ = Describe("Receiving GOAWAY", func() {
+	var (
+		session *Session
+		peer    *Framer
+	)
+
+	BeforeEach(func() {
+		session, peer = newPeer(false, nil)
+	})
+
+	AfterEach(func() {
+		session.Close()
+	})
+
+	It("should fail streams the peer did not process", func() {
+		go session.OpenStream(NameValuePairs{})
+		readFrame(peer)
+		go session.OpenStream(NameValuePairs{})
+		readFrame(peer)
+		stream1, stream3 := session.getStream(1), session.getStream(3)
+
+		Expect(peer.Write(&GoAway{LastGoodStreamId: 1})).To(Succeed())
+		Eventually(func() error {
+			stream3.mu.Lock()
+			defer stream3.mu.Unlock()
+			return stream3.err
+		}).Should(Equal(ErrGoAway))
+		Eventually(func() *Stream { return session.getStream(3) }).Should(BeNil())
+
+		stream1.mu.Lock()
+		defer stream1.mu.Unlock()
+		Expect(stream1.err).To(BeNil())
+	})
+
+	It("should not open any more streams", func() {
+		Expect(peer.Write(&GoAway{})).To(Succeed())
+		Eventually(func() bool {
+			session.mu.Lock()
+			defer session.mu.Unlock()
+			return session.goAwayReceived
+		}).Should(BeTrue())
+
+		_, err := session.OpenStream(NameValuePairs{})
+		Expect(err).To(Equal(ErrGoAway))
+	})
+})
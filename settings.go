@@ -0,0 +1,198 @@
+package spdy3
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// ----------------------------------------------------------------------------
+// Settings Store
+//
+// A server can ask a client to remember settings across sessions by sending
+// them with FLAG_SETTINGS_PERSIST_VALUE. The client returns them at the start
+// of its next session with the same origin, marked FLAG_SETTINGS_PERSISTED,
+// until the server sends FLAG_SETTINGS_CLEAR_SETTINGS.
+type SettingsStore interface {
+	// Get returns the settings persisted for an origin, if any.
+	Get(origin string) ([]*Setting, error)
+
+	// Set replaces the settings persisted for an origin.
+	Set(origin string, settings []*Setting) error
+
+	// Clear forgets all the settings persisted for an origin.
+	Clear(origin string) error
+}
+
+// ----------------------------------------------------------------------------
+// Memory Settings Store
+//
+// Keeps persisted settings for the lifetime of the process.
+type MemorySettingsStore struct {
+	mu       sync.Mutex
+	settings map[string][]*Setting
+}
+
+func NewMemorySettingsStore() *MemorySettingsStore {
+	return &MemorySettingsStore{
+		settings: make(map[string][]*Setting),
+	}
+}
+
+func (m *MemorySettingsStore) Get(origin string) ([]*Setting, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return copySettings(m.settings[origin]), nil
+}
+
+func (m *MemorySettingsStore) Set(origin string, settings []*Setting) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.settings[origin] = copySettings(settings)
+	return nil
+}
+
+func (m *MemorySettingsStore) Clear(origin string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.settings, origin)
+	return nil
+}
+
+// Ensure MemorySettingsStore is a SettingsStore
+var _ SettingsStore = &MemorySettingsStore{}
+
+// ----------------------------------------------------------------------------
+// File Settings Store
+//
+// Keeps persisted settings in a JSON file, so they outlive the process. The
+// whole file is read and rewritten on each change.
+type FileSettingsStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+type fileSetting struct {
+	Id    SettingsId `json:"id"`
+	Value int32      `json:"value"`
+}
+
+func NewFileSettingsStore(path string) *FileSettingsStore {
+	return &FileSettingsStore{
+		path: path,
+	}
+}
+
+func (f *FileSettingsStore) Get(origin string) ([]*Setting, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	origins, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+
+	var settings []*Setting
+	for _, setting := range origins[origin] {
+		settings = append(settings, &Setting{
+			Id:    setting.Id,
+			Value: setting.Value,
+		})
+	}
+	return settings, nil
+}
+
+func (f *FileSettingsStore) Set(origin string, settings []*Setting) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	origins, err := f.load()
+	if err != nil {
+		return err
+	}
+
+	stored := make([]fileSetting, len(settings))
+	for i, setting := range settings {
+		stored[i] = fileSetting{
+			Id:    setting.Id,
+			Value: setting.Value,
+		}
+	}
+	origins[origin] = stored
+	return f.save(origins)
+}
+
+func (f *FileSettingsStore) Clear(origin string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	origins, err := f.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := origins[origin]; !ok {
+		return nil
+	}
+	delete(origins, origin)
+	return f.save(origins)
+}
+
+func (f *FileSettingsStore) load() (map[string][]fileSetting, error) {
+	origins := make(map[string][]fileSetting)
+
+	bs, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return origins, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(bs, &origins); err != nil {
+		return nil, err
+	}
+	return origins, nil
+}
+
+// save writes the file in full alongside the old one, then moves it into place
+// so a crash never leaves it half written.
+func (f *FileSettingsStore) save(origins map[string][]fileSetting) error {
+	bs, err := json.Marshal(origins)
+	if err != nil {
+		return err
+	}
+
+	tmp := f.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, bs, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// Ensure FileSettingsStore is a SettingsStore
+var _ SettingsStore = &FileSettingsStore{}
+
+// ----------------------------------------------------------------------------
+// Helper functions
+
+func copySettings(settings []*Setting) []*Setting {
+	if settings == nil {
+		return nil
+	}
+	copied := make([]*Setting, len(settings))
+	for i, setting := range settings {
+		s := *setting
+		copied[i] = &s
+	}
+	return copied
+}
+
+// mergeSettings replaces or adds each of updates in settings, returning the
+// result.
+func mergeSettings(settings, updates []*Setting) []*Setting {
+	merged := &Settings{Settings: copySettings(settings)}
+	for _, update := range updates {
+		merged.Set(update.Id, update.Value, 0)
+	}
+	return merged.Settings
+}
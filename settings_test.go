@@ -0,0 +1,189 @@
+package spdy3
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Both stores should behave the same
+func describeSettingsStore(newStore func() SettingsStore) {
+	var store SettingsStore
+
+	BeforeEach(func() {
+		store = newStore()
+	})
+
+	It("should have nothing for an unknown origin", func() {
+		Expect(store.Get("https://example.com:443")).To(BeEmpty())
+	})
+
+	It("should keep settings per origin", func() {
+		Expect(store.Set("https://a:443", []*Setting{
+			{Id: SettingsRoundTripTime, Value: 10},
+		})).To(Succeed())
+		Expect(store.Set("https://b:443", []*Setting{
+			{Id: SettingsCurrentCwnd, Value: 20},
+		})).To(Succeed())
+
+		Expect(store.Get("https://a:443")).To(Equal([]*Setting{
+			{Id: SettingsRoundTripTime, Value: 10},
+		}))
+		Expect(store.Get("https://b:443")).To(Equal([]*Setting{
+			{Id: SettingsCurrentCwnd, Value: 20},
+		}))
+	})
+
+	It("should clear an origin", func() {
+		Expect(store.Set("https://a:443", []*Setting{
+			{Id: SettingsRoundTripTime, Value: 10},
+		})).To(Succeed())
+		Expect(store.Clear("https://a:443")).To(Succeed())
+		Expect(store.Get("https://a:443")).To(BeEmpty())
+	})
+}
+
+var _ = Describe("MemorySettingsStore", func() {
+	describeSettingsStore(func() SettingsStore {
+		return NewMemorySettingsStore()
+	})
+})
+
+var _ = Describe("FileSettingsStore", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "spdy3")
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	describeSettingsStore(func() SettingsStore {
+		return NewFileSettingsStore(filepath.Join(dir, "settings.json"))
+	})
+
+	It("should outlive the store", func() {
+		path := filepath.Join(dir, "settings.json")
+		Expect(NewFileSettingsStore(path).Set("https://a:443", []*Setting{
+			{Id: SettingsDownloadBandwidth, Value: 99},
+		})).To(Succeed())
+
+		Expect(NewFileSettingsStore(path).Get("https://a:443")).To(Equal([]*Setting{
+			{Id: SettingsDownloadBandwidth, Value: 99},
+		}))
+	})
+})
+
+var _ = Describe("Session settings persistence", func() {
+	const origin = "https://example.com:443"
+
+	var (
+		store   *MemorySettingsStore
+		session *Session
+		peer    *Framer
+	)
+
+	BeforeEach(func() {
+		store = NewMemorySettingsStore()
+	})
+
+	AfterEach(func() {
+		session.Close()
+	})
+
+	connect := func() {
+		session, peer = newPeer(false, &Config{
+			SettingsStore: store,
+			Origin:        origin,
+		})
+	}
+
+	It("should replay persisted settings when it connects", func() {
+		store.Set(origin, []*Setting{{Id: SettingsRoundTripTime, Value: 30}})
+		connect()
+
+		Expect(readFrame(peer)).To(Equal(&Settings{Settings: []*Setting{{
+			Flags: FlagSettingsPersisted,
+			Id:    SettingsRoundTripTime,
+			Value: 30,
+		}}}))
+	})
+
+	It("should replay persisted settings apart from its own limits", func() {
+		store.Set(origin, []*Setting{{Id: SettingsMaxConcurrentStreams, Value: 100}})
+		session, peer = newPeer(false, &Config{
+			SettingsStore:        store,
+			Origin:               origin,
+			MaxConcurrentStreams: 10,
+		})
+
+		Expect(readFrame(peer)).To(Equal(&Settings{Settings: []*Setting{
+			{Flags: FlagSettingsPersisted, Id: SettingsMaxConcurrentStreams, Value: 100},
+		}}))
+		Expect(readFrame(peer)).To(Equal(&Settings{Settings: []*Setting{
+			{Id: SettingsMaxConcurrentStreams, Value: 10},
+		}}))
+	})
+
+	It("should not take the settings a client replays as its limits", func() {
+		session, peer = newPeer(true, nil)
+		Expect(peer.Write(&Settings{Settings: []*Setting{
+			{Flags: FlagSettingsPersisted, Id: SettingsMaxConcurrentStreams, Value: 1},
+			{Flags: FlagSettingsPersisted, Id: SettingsInitialWindowSize, Value: 1},
+		}})).To(Succeed())
+		Expect(peer.Write(&Ping{Id: 1})).To(Succeed())
+		Expect(readFrame(peer)).To(Equal(&Ping{Id: 1}))
+
+		session.mu.Lock()
+		defer session.mu.Unlock()
+		Expect(session.peerMaxStreams).To(Equal(-1))
+		Expect(session.initialSendWindow).To(Equal(int32(defaultInitialWindowSize)))
+	})
+
+	It("should persist settings the server asks it to", func() {
+		store.Set(origin, []*Setting{{Id: SettingsRoundTripTime, Value: 30}})
+		connect()
+		readFrame(peer)
+
+		Expect(peer.Write(&Settings{Settings: []*Setting{
+			{Flags: FlagSettingsPersistValue, Id: SettingsRoundTripTime, Value: 40},
+			{Flags: FlagSettingsPersistValue, Id: SettingsCurrentCwnd, Value: 10},
+			{Id: SettingsDownloadBandwidth, Value: 5},
+		}})).To(Succeed())
+
+		Eventually(func() []*Setting {
+			settings, _ := store.Get(origin)
+			return settings
+		}).Should(Equal([]*Setting{
+			{Id: SettingsRoundTripTime, Value: 40},
+			{Id: SettingsCurrentCwnd, Value: 10},
+		}))
+	})
+
+	It("should clear persisted settings when told to", func() {
+		store.Set(origin, []*Setting{{Id: SettingsRoundTripTime, Value: 30}})
+		connect()
+		readFrame(peer)
+
+		Expect(peer.Write(&Settings{
+			Flags: FlagSettingsClearSettings,
+			Settings: []*Setting{
+				{Flags: FlagSettingsPersistValue, Id: SettingsCurrentCwnd, Value: 10},
+			},
+		})).To(Succeed())
+
+		Eventually(func() []*Setting {
+			settings, _ := store.Get(origin)
+			return settings
+		}).Should(Equal([]*Setting{
+			{Id: SettingsCurrentCwnd, Value: 10},
+		}))
+	})
+})
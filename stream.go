@@ -0,0 +1,598 @@
+package spdy3
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	ErrAlreadyReplied = errors.New("Stream has already been replied to")
+	ErrWriteClosed    = errors.New("Write on a stream closed for writing")
+	ErrReadClosed     = errors.New("Read on a stream closed for reading")
+	ErrCannotPush     = errors.New("Only a server can push, on a stream the client opened")
+)
+
+// The most data written in a single DATA frame.
+const maxDataFrameSize = 0x4000
+
+type StreamState int
+
+const (
+	// Both ends may send frames.
+	StreamOpen StreamState = iota
+	// We have sent a FIN, the peer may still send.
+	StreamHalfClosedLocal
+	// The peer has sent a FIN, we may still send.
+	StreamHalfClosedRemote
+	// Both ends have sent a FIN, or the stream was reset.
+	StreamClosed
+)
+
+// ----------------------------------------------------------------------------
+// Stream
+//
+// A Stream is a single bidirectional sequence of frames within a Session. Its
+// data can be read and written like any other connection, and each direction
+// can be closed on its own: CloseWrite sends a FIN, after which the peer can
+// still send data until it sends a FIN of its own.
+type Stream struct {
+	id           uint32
+	associatedId uint32
+	session      *Session
+	priority     uint8
+	headers      NameValuePairs
+	credential   []*x509.Certificate
+
+	// Cancelled once the stream is reset or its session closes.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	replyHeaders NameValuePairs
+	moreHeaders  NameValuePairs
+	replied      bool
+	buf          bytes.Buffer
+	remoteClosed bool
+	localClosed  bool
+	readClosed   bool
+	err          error
+
+	// Flow control. The send window is how much more data the peer will take,
+	// and Write blocks while it is used up. The receive window is how much more
+	// the peer may send us. Data which has been read but not yet returned to
+	// the peer in a WINDOW_UPDATE is held in unacked.
+	sendWindow int32
+	recvWindow int32
+	unacked    int32
+}
+
+func newStream(session *Session, id uint32, headers NameValuePairs) *Stream {
+	stream := &Stream{
+		id:         id,
+		session:    session,
+		headers:    headers,
+		sendWindow: session.initialSendWindow,
+		recvWindow: session.initialRecvWindow,
+	}
+	stream.ctx, stream.cancel = context.WithCancel(context.Background())
+	stream.cond = sync.NewCond(&stream.mu)
+	return stream
+}
+
+// Context returns a context which is cancelled once the stream is reset, by
+// either end, or its session closes.
+func (s *Stream) Context() context.Context {
+	return s.ctx
+}
+
+// Id is the stream's id within its session.
+func (s *Stream) Id() uint32 {
+	return s.id
+}
+
+// Priority is the priority the stream was opened with, 0 being the highest and
+// 7 the lowest.
+func (s *Stream) Priority() uint8 {
+	return s.priority
+}
+
+// AssociatedStreamId is the id of the stream a pushed stream was pushed
+// alongside, or 0 if the stream was not pushed.
+func (s *Stream) AssociatedStreamId() uint32 {
+	return s.associatedId
+}
+
+// Credential is the client certificate chain a stream opened by the peer was
+// sent with, from the slot named in its SYN_STREAM, or nil if it named none.
+// The client has proved it holds the chain's private key for the origin of the
+// stream, but the chain itself has not been verified.
+func (s *Stream) Credential() []*x509.Certificate {
+	return s.credential
+}
+
+// Headers are the headers the stream was opened with.
+func (s *Stream) Headers() NameValuePairs {
+	return s.headers
+}
+
+// ReplyHeaders returns the headers of the stream's SYN_REPLY, along with any
+// received in later HEADERS frames. For a stream we opened this waits until
+// the peer has replied.
+func (s *Stream) ReplyHeaders() (NameValuePairs, error) {
+	return s.waitForReply(true)
+}
+
+// waitForReply returns a copy of the headers of the stream's SYN_REPLY, along
+// with those of later HEADERS frames if more is set.
+func (s *Stream) waitForReply(more bool) (NameValuePairs, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.session.isLocalId(s.id) && !s.replied && s.err == nil {
+		s.cond.Wait()
+	}
+	if !s.replied && s.err != nil {
+		return nil, s.err
+	}
+
+	headers := make(NameValuePairs, len(s.replyHeaders))
+	for name, values := range s.replyHeaders {
+		headers[name] = append([]string(nil), values...)
+	}
+	if more {
+		for name, values := range s.moreHeaders {
+			headers[name] = append(headers[name], values...)
+		}
+	}
+	return headers, nil
+}
+
+// State reports which ends of the stream are still open.
+func (s *Stream) State() StreamState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stateLocked()
+}
+
+func (s *Stream) stateLocked() StreamState {
+	switch {
+	case s.err != nil, s.localClosed && s.remoteClosed:
+		return StreamClosed
+	case s.localClosed:
+		return StreamHalfClosedLocal
+	case s.remoteClosed:
+		return StreamHalfClosedRemote
+	}
+	return StreamOpen
+}
+
+// Reply accepts a stream opened by the peer with a SYN_REPLY frame.
+func (s *Stream) Reply(headers NameValuePairs) error {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return s.err
+	}
+	if s.localClosed {
+		s.mu.Unlock()
+		return ErrWriteClosed
+	}
+	if s.session.isLocalId(s.id) || s.replied {
+		s.mu.Unlock()
+		return ErrAlreadyReplied
+	}
+	s.replied = true
+	s.replyHeaders = headers
+	s.mu.Unlock()
+
+	return s.session.writeFrame(&SynReply{
+		StreamId: s.id,
+		Headers:  headers,
+	})
+}
+
+// Push opens a stream from the server alongside this one, which was opened by
+// the client, to send it something it has not asked for yet. The pushed stream
+// is write-only, and headers should describe the resource it carries. Pushes
+// must all be made before this stream is closed for writing.
+func (s *Stream) Push(headers NameValuePairs) (*Stream, error) {
+	if !s.session.server || s.session.isLocalId(s.id) {
+		return nil, ErrCannotPush
+	}
+
+	s.mu.Lock()
+	err := s.err
+	if err == nil && s.localClosed {
+		err = ErrWriteClosed
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.session.openStream(headers, s.priority, 0, 0, s)
+}
+
+// Read reads data sent by the peer. Once the peer has half-closed the stream
+// and all of its data has been read, Read returns io.EOF. Data which arrived
+// before the session closed can still be read, after which Read fails.
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		switch {
+		case s.readClosed:
+			return 0, ErrReadClosed
+		case s.buf.Len() > 0:
+			n, err := s.buf.Read(p)
+			s.consumedLocked(n)
+			return n, err
+		case s.err != nil:
+			return 0, s.err
+		case s.remoteClosed:
+			return 0, io.EOF
+		}
+		s.cond.Wait()
+	}
+}
+
+// Write sends p to the peer in one or more DATA frames. A stream opened by the
+// peer is implicitly replied to with no headers if Reply was not called first.
+// Write blocks while the peer's flow control window is used up.
+func (s *Stream) Write(p []byte) (n int, err error) {
+	if err = s.prepareWrite(); err != nil {
+		return
+	}
+
+	for len(p) > 0 {
+		var size int
+		if size, err = s.reserveWindow(len(p)); err != nil {
+			return
+		}
+		if err = s.session.writeStreamFrame(&DataFrame{
+			StreamId: s.id,
+			Data:     p[:size],
+		}, s.priority); err != nil {
+			return
+		}
+		n += size
+		p = p[size:]
+	}
+	return
+}
+
+// WriteHeaders sends the peer more headers in a HEADERS frame, such as the
+// trailers of an HTTP response or the status of a pushed one. Like Write, it
+// replies to a stream opened by the peer if Reply was not called first.
+func (s *Stream) WriteHeaders(headers NameValuePairs) error {
+	if err := s.prepareWrite(); err != nil {
+		return err
+	}
+	return s.session.writeStreamFrame(&Headers{
+		StreamId: s.id,
+		Headers:  headers,
+	}, s.priority)
+}
+
+// reserveWindow waits for room in the send window, and takes as much of it as
+// the next frame of a write of size bytes can use. Under SPDY/3.1 that is also
+// taken from the session's window, and whatever the session cannot spare is
+// given back to the stream. SPDY/2 has no windows to wait for.
+func (s *Stream) reserveWindow(size int) (int, error) {
+	size, err := s.reserveStreamWindow(size)
+	if err != nil || !s.session.sessionFlowControl() {
+		return size, err
+	}
+
+	granted, err := s.session.reserveWindow(size)
+	if granted < size {
+		s.adjustSendWindow(int32(size - granted))
+	}
+	return granted, err
+}
+
+func (s *Stream) reserveStreamWindow(size int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	flowControl := s.session.flowControl()
+	for flowControl && s.sendWindow <= 0 && s.err == nil && !s.localClosed {
+		s.cond.Wait()
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	if s.localClosed {
+		return 0, ErrWriteClosed
+	}
+
+	if size > maxDataFrameSize {
+		size = maxDataFrameSize
+	}
+	if !flowControl {
+		return size, nil
+	}
+	if size > int(s.sendWindow) {
+		size = int(s.sendWindow)
+	}
+	s.sendWindow -= int32(size)
+	return size, nil
+}
+
+// consumedLocked hands n bytes of the receive window back to the peer once
+// enough has been read to be worth a WINDOW_UPDATE.
+func (s *Stream) consumedLocked(n int) {
+	if !s.session.flowControl() {
+		return
+	}
+	s.session.consumed(n)
+	s.unacked += int32(n)
+	if s.unacked < s.session.initialRecvWindow/2 || s.remoteClosed {
+		return
+	}
+
+	s.recvWindow += s.unacked
+	s.session.queue(&WindowUpdate{
+		StreamId:        s.id,
+		DeltaWindowSize: uint32(s.unacked),
+	})
+	s.unacked = 0
+}
+
+// prepareWrite checks the stream can be written to, and sends the implicit
+// SYN_REPLY if one is needed.
+func (s *Stream) prepareWrite() error {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return s.err
+	}
+	if s.localClosed {
+		s.mu.Unlock()
+		return ErrWriteClosed
+	}
+	if s.session.isLocalId(s.id) || s.replied {
+		s.mu.Unlock()
+		return nil
+	}
+	headers := make(NameValuePairs)
+	s.replied = true
+	s.replyHeaders = headers
+	s.mu.Unlock()
+
+	return s.session.writeFrame(&SynReply{
+		StreamId: s.id,
+		Headers:  headers,
+	})
+}
+
+// CloseWrite half-closes the stream by sending a FIN. The peer may carry on
+// sending data until it closes its own half.
+func (s *Stream) CloseWrite() error {
+	return s.closeWrite(make(NameValuePairs))
+}
+
+// closeWrite half-closes the stream. A stream opened by the peer which has not
+// been replied to is sent the FIN on a SYN_REPLY carrying headers.
+func (s *Stream) closeWrite(headers NameValuePairs) error {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return s.err
+	}
+	if s.localClosed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.localClosed = true
+
+	var frame Frame
+	if !s.session.isLocalId(s.id) && !s.replied {
+		s.replied = true
+		s.replyHeaders = headers
+		frame = &SynReply{
+			Flags:    FlagFin,
+			StreamId: s.id,
+			Headers:  s.replyHeaders,
+		}
+	} else {
+		frame = &DataFrame{
+			Flags:    FlagFin,
+			StreamId: s.id,
+			Data:     []byte{},
+		}
+	}
+	// Queue the FIN before the stream can be removed, so a session shutting
+	// down once its streams are done will still send it.
+	done := s.session.schedule(frame, s.priority)
+	s.removeIfClosedLocked()
+	s.mu.Unlock()
+
+	return <-done
+}
+
+// Close half-closes the stream for writing and stops reading from it. Any data
+// the peer sends afterwards is discarded.
+func (s *Stream) Close() error {
+	err := s.CloseWrite()
+	s.closeRead()
+	return err
+}
+
+// closeRead stops reading from the stream, discarding anything the peer has
+// sent or goes on to send.
+func (s *Stream) closeRead() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readClosed = true
+	s.consumedLocked(s.buf.Len())
+	s.buf.Reset()
+	s.cond.Broadcast()
+}
+
+// Reset abnormally terminates the stream with a RST_STREAM frame. Pending and
+// future reads and writes fail with a *StreamError carrying status.
+func (s *Stream) Reset(status RstStreamStatus) error {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return s.err
+	}
+	err := s.errorf(status, "reset locally")
+	s.err = err
+	s.discardLocked()
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.cancel()
+
+	s.session.abortStream(s.id, err)
+	return s.session.writeFrame(err.Frame())
+}
+
+// closeWithError fails any pending or future operations on the stream.
+func (s *Stream) closeWithError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.discardLocked()
+	s.cond.Broadcast()
+	s.cancel()
+}
+
+// sessionClosed fails the stream along with its session. Unlike a reset, data
+// already received is kept for Read to return before the error.
+func (s *Stream) sessionClosed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.cancel()
+}
+
+// discardLocked throws away data which will never be read now that the stream
+// has failed, handing its share of the session window back to the peer.
+func (s *Stream) discardLocked() {
+	s.session.consumed(s.buf.Len())
+	s.buf.Reset()
+}
+
+// removeIfClosedLocked takes a stream which both ends have finished out of its
+// session.
+func (s *Stream) removeIfClosedLocked() {
+	if s.localClosed && s.remoteClosed {
+		s.session.removeStream(s.id)
+	}
+}
+
+func (s *Stream) handleReply(frame *SynReply) *StreamError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.session.isLocalId(s.id) {
+		return s.errorf(ProtocolError, "SYN_REPLY on a stream opened by the peer")
+	}
+	if s.replied {
+		return s.errorf(StreamInUse, "second SYN_REPLY")
+	}
+
+	s.replied = true
+	s.replyHeaders = frame.Headers
+	if frame.Flags&FlagFin != 0 {
+		s.remoteClosed = true
+		s.removeIfClosedLocked()
+	}
+	s.cond.Broadcast()
+	return nil
+}
+
+func (s *Stream) handleHeaders(frame *Headers) *StreamError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.remoteClosed {
+		return s.errorf(StreamAlreadyClosed, "HEADERS after FIN")
+	}
+
+	if s.moreHeaders == nil {
+		s.moreHeaders = make(NameValuePairs)
+	}
+	for name, values := range frame.Headers {
+		s.moreHeaders[name] = append(s.moreHeaders[name], values...)
+	}
+	if frame.Flags&FlagFin != 0 {
+		s.remoteClosed = true
+		s.removeIfClosedLocked()
+	}
+	s.cond.Broadcast()
+	return nil
+}
+
+func (s *Stream) handleData(frame *DataFrame) *StreamError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.remoteClosed {
+		return s.errorf(StreamAlreadyClosed, "DATA after FIN")
+	}
+	if s.session.isLocalId(s.id) && !s.replied {
+		return s.errorf(ProtocolError, "DATA before SYN_REPLY")
+	}
+
+	if s.session.flowControl() {
+		if len(frame.Data) > int(s.recvWindow) {
+			return s.errorf(FlowControlError, "DATA overran the receive window")
+		}
+		s.recvWindow -= int32(len(frame.Data))
+	}
+
+	if s.readClosed {
+		s.consumedLocked(len(frame.Data))
+	} else {
+		s.buf.Write(frame.Data)
+	}
+	if frame.Flags&FlagFin != 0 {
+		s.remoteClosed = true
+		s.removeIfClosedLocked()
+	}
+	s.cond.Broadcast()
+	return nil
+}
+
+func (s *Stream) handleWindowUpdate(frame *WindowUpdate) *StreamError {
+	return s.adjustSendWindow(int32(frame.DeltaWindowSize))
+}
+
+// adjustSendWindow moves the send window by delta, waking any writers waiting
+// on it to open.
+func (s *Stream) adjustSendWindow(delta int32) *StreamError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if int64(s.sendWindow)+int64(delta) > maxWindowSize {
+		return s.errorf(FlowControlError, "send window overflowed")
+	}
+	s.sendWindow += delta
+	s.cond.Broadcast()
+	return nil
+}
+
+func (s *Stream) errorf(status RstStreamStatus, reason string) *StreamError {
+	return &StreamError{
+		StreamId:   s.id,
+		StatusCode: status,
+		Reason:     reason,
+	}
+}
+
+// Ensure Stream can stand in for a connection
+var _ io.ReadWriteCloser = &Stream{}
@@ -0,0 +1,647 @@
+package spdy3
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Stream", func() {
+	var (
+		client, server *Session
+		stream, peer   *Stream
+	)
+
+	BeforeEach(func() {
+		var err error
+		client, server = newSessionPair(nil, nil)
+		stream, err = client.OpenStream(NameValuePairs{":path": {"/"}})
+		Expect(err).To(BeNil())
+		peer, err = server.AcceptStream()
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		client.Close()
+		server.Close()
+	})
+
+	It("should expose its headers", func() {
+		Expect(peer.Headers()).To(Equal(NameValuePairs{":path": {"/"}}))
+		Expect(peer.Reply(NameValuePairs{":status": {"200"}})).To(Succeed())
+		Expect(stream.ReplyHeaders()).To(Equal(NameValuePairs{":status": {"200"}}))
+	})
+
+	It("should carry data both ways", func() {
+		go func() {
+			defer GinkgoRecover()
+			peer.Write([]byte("pong"))
+			peer.CloseWrite()
+		}()
+		_, err := stream.Write([]byte("ping"))
+		Expect(err).To(BeNil())
+		Expect(stream.CloseWrite()).To(Succeed())
+
+		Expect(ioutil.ReadAll(peer)).To(Equal([]byte("ping")))
+		Expect(ioutil.ReadAll(stream)).To(Equal([]byte("pong")))
+	})
+
+	It("should split large writes into frames", func() {
+		data := make([]byte, 3*maxDataFrameSize+1)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		go func() {
+			defer GinkgoRecover()
+			Expect(stream.Write(data)).To(Equal(len(data)))
+			stream.CloseWrite()
+		}()
+		Expect(ioutil.ReadAll(peer)).To(Equal(data))
+	})
+
+	It("should reply implicitly on the first write", func() {
+		go peer.Write([]byte("x"))
+		Expect(stream.ReplyHeaders()).To(Equal(NameValuePairs{}))
+	})
+
+	It("should reply with a FIN when closed before replying", func() {
+		Expect(peer.CloseWrite()).To(Succeed())
+		Expect(stream.ReplyHeaders()).To(Equal(NameValuePairs{}))
+		_, err := stream.Read(make([]byte, 1))
+		Expect(err).To(Equal(io.EOF))
+		Expect(stream.State()).To(Equal(StreamHalfClosedRemote))
+	})
+
+	It("should model half-closed states", func() {
+		Expect(stream.State()).To(Equal(StreamOpen))
+
+		Expect(stream.CloseWrite()).To(Succeed())
+		Expect(stream.State()).To(Equal(StreamHalfClosedLocal))
+		_, err := stream.Write([]byte("late"))
+		Expect(err).To(Equal(ErrWriteClosed))
+
+		Expect(ioutil.ReadAll(peer)).To(HaveLen(0))
+		Expect(peer.State()).To(Equal(StreamHalfClosedRemote))
+
+		// The half we have not closed still works
+		go peer.Write([]byte("still open"))
+		buf := make([]byte, 10)
+		Expect(io.ReadFull(stream, buf)).To(Equal(10))
+
+		Expect(peer.CloseWrite()).To(Succeed())
+		Expect(peer.State()).To(Equal(StreamClosed))
+		_, err = stream.Read(buf)
+		Expect(err).To(Equal(io.EOF))
+		Expect(stream.State()).To(Equal(StreamClosed))
+		Expect(client.getStream(stream.Id())).To(BeNil())
+	})
+
+	It("should stop reading once closed", func() {
+		Expect(stream.Close()).To(Succeed())
+		_, err := stream.Read(make([]byte, 1))
+		Expect(err).To(Equal(ErrReadClosed))
+	})
+
+	It("should fail both ends when reset", func() {
+		Expect(stream.Reset(Cancel)).To(Succeed())
+		Expect(stream.State()).To(Equal(StreamClosed))
+
+		_, err := peer.Read(make([]byte, 1))
+		Expect(err).To(BeAssignableToTypeOf(&StreamError{}))
+		Expect(err.(*StreamError).StatusCode).To(Equal(Cancel))
+
+		_, err = stream.Write([]byte("x"))
+		Expect(err.(*StreamError).StatusCode).To(Equal(Cancel))
+	})
+
+	It("should return data received before the session closed", func() {
+		peer.Write([]byte("hello"))
+		Eventually(func() int {
+			stream.mu.Lock()
+			defer stream.mu.Unlock()
+			return stream.buf.Len()
+		}).Should(Equal(5))
+		client.Close()
+
+		data, err := ioutil.ReadAll(stream)
+		Expect(data).To(Equal([]byte("hello")))
+		Expect(err).To(Equal(ErrSessionClosed))
+	})
+})
+
+var _ = Describe("Stream resets", func() {
+	var (
+		session *Session
+		peer    *Framer
+		stream  *Stream
+	)
+
+	BeforeEach(func() {
+		session, peer = newPeer(false, nil)
+		go session.OpenStream(NameValuePairs{})
+		readFrame(peer)
+		stream = session.getStream(1)
+	})
+
+	AfterEach(func() {
+		session.Close()
+	})
+
+	It("should not send DATA queued before the reset", func() {
+		errs := make(chan error, 3)
+		for i := 0; i < 3; i++ {
+			go func() {
+				_, err := stream.Write([]byte("x"))
+				errs <- err
+			}()
+		}
+
+		// One frame is stuck on its way to the peer, the rest are queued
+		Eventually(func() int {
+			session.mu.Lock()
+			defer session.mu.Unlock()
+			if writes, ok := session.writes.streams[1]; ok {
+				return len(writes.writes)
+			}
+			return 0
+		}).Should(Equal(2))
+		go stream.Reset(Cancel)
+		Eventually(func() bool {
+			session.mu.Lock()
+			defer session.mu.Unlock()
+			_, ok := session.writes.streams[1]
+			return ok
+		}).Should(BeFalse())
+
+		Expect(readFrame(peer)).To(BeAssignableToTypeOf(&DataFrame{}))
+		Expect(readFrame(peer)).To(Equal(&RstStream{StreamId: 1, StatusCode: Cancel}))
+
+		go session.Ping(context.Background())
+		Expect(readFrame(peer)).To(BeAssignableToTypeOf(&Ping{}))
+
+		var failed int
+		for i := 0; i < 3; i++ {
+			var err error
+			Eventually(errs).Should(Receive(&err))
+			if err != nil {
+				Expect(err.(*StreamError).StatusCode).To(Equal(Cancel))
+				failed++
+			}
+		}
+		Expect(failed).To(Equal(2))
+	})
+})
+
+var _ = Describe("Stream flow control", func() {
+	var (
+		session *Session
+		peer    *Framer
+		stream  *Stream
+	)
+
+	BeforeEach(func() {
+		session, peer = newPeer(false, nil)
+		go session.OpenStream(NameValuePairs{})
+		readFrame(peer)
+		stream = session.getStream(1)
+		Expect(peer.Write(&SynReply{StreamId: 1, Headers: NameValuePairs{}})).To(Succeed())
+	})
+
+	AfterEach(func() {
+		session.Close()
+	})
+
+	// readData reads DATA frames from the peer until n bytes have arrived.
+	readData := func(n int) {
+		for n > 0 {
+			frame := readFrame(peer).(*DataFrame)
+			n -= len(frame.Data)
+		}
+		Expect(n).To(Equal(0))
+	}
+
+	It("should block writers once the window is used up", func() {
+		written := make(chan int, 1)
+		go func() {
+			n, _ := stream.Write(make([]byte, defaultInitialWindowSize+10))
+			written <- n
+		}()
+
+		readData(defaultInitialWindowSize)
+		Consistently(written).ShouldNot(Receive())
+
+		Expect(peer.Write(&WindowUpdate{StreamId: 1, DeltaWindowSize: 10})).To(Succeed())
+		readData(10)
+		Eventually(written).Should(Receive(Equal(defaultInitialWindowSize + 10)))
+	})
+
+	It("should open the window as data is read", func() {
+		Expect(peer.Write(&DataFrame{
+			StreamId: 1,
+			Data:     make([]byte, 40000),
+		})).To(Succeed())
+
+		go func() {
+			defer GinkgoRecover()
+			buf := make([]byte, 40000)
+			Expect(io.ReadFull(stream, buf)).To(Equal(40000))
+		}()
+		Expect(readFrame(peer)).To(Equal(&WindowUpdate{
+			StreamId:        1,
+			DeltaWindowSize: 40000,
+		}))
+	})
+
+	It("should not update the window for small reads", func() {
+		Expect(peer.Write(&DataFrame{
+			StreamId: 1,
+			Data:     make([]byte, 100),
+		})).To(Succeed())
+		Expect(io.ReadFull(stream, make([]byte, 100))).To(Equal(100))
+
+		stream.mu.Lock()
+		defer stream.mu.Unlock()
+		Expect(stream.unacked).To(Equal(int32(100)))
+		Expect(stream.recvWindow).To(Equal(int32(defaultInitialWindowSize - 100)))
+	})
+
+	It("should reset a stream which overruns its window", func() {
+		Expect(peer.Write(&DataFrame{
+			StreamId: 1,
+			Data:     make([]byte, defaultInitialWindowSize+1),
+		})).To(Succeed())
+		Expect(readFrame(peer)).To(Equal(&RstStream{
+			StreamId:   1,
+			StatusCode: FlowControlError,
+		}))
+
+		_, err := stream.Read(make([]byte, 1))
+		Expect(err.(*StreamError).StatusCode).To(Equal(FlowControlError))
+	})
+
+	It("should reset a stream whose window overflows", func() {
+		Expect(peer.Write(&WindowUpdate{
+			StreamId:        1,
+			DeltaWindowSize: maxWindowSize,
+		})).To(Succeed())
+		Expect(readFrame(peer)).To(Equal(&RstStream{
+			StreamId:   1,
+			StatusCode: FlowControlError,
+		}))
+	})
+})
+
+var _ = Describe("Initial window size changes", func() {
+	var (
+		session *Session
+		peer    *Framer
+		stream  *Stream
+	)
+
+	BeforeEach(func() {
+		session, peer = newPeer(false, nil)
+		go session.OpenStream(NameValuePairs{})
+		readFrame(peer)
+		stream = session.getStream(1)
+		Expect(peer.Write(&SynReply{StreamId: 1, Headers: NameValuePairs{}})).To(Succeed())
+	})
+
+	AfterEach(func() {
+		session.Close()
+	})
+
+	sendWindow := func(stream *Stream) func() int32 {
+		return func() int32 {
+			stream.mu.Lock()
+			defer stream.mu.Unlock()
+			return stream.sendWindow
+		}
+	}
+
+	setInitialWindow := func(size int32) {
+		Expect(peer.Write(&Settings{Settings: []*Setting{{
+			Id:    SettingsInitialWindowSize,
+			Value: size,
+		}}})).To(Succeed())
+	}
+
+	It("should shrink open streams' windows below zero", func() {
+		go stream.Write(make([]byte, 60000))
+		for n := 0; n < 60000; {
+			n += len(readFrame(peer).(*DataFrame).Data)
+		}
+		Eventually(sendWindow(stream)).Should(Equal(int32(5536)))
+
+		setInitialWindow(1000)
+		Eventually(sendWindow(stream)).Should(Equal(int32(5536 - 64536)))
+
+		written := make(chan int, 1)
+		go func() {
+			n, _ := stream.Write(make([]byte, 500))
+			written <- n
+		}()
+		Consistently(written).ShouldNot(Receive())
+
+		// Growing back to zero still leaves no room to write
+		Expect(peer.Write(&WindowUpdate{StreamId: 1, DeltaWindowSize: 59000})).To(Succeed())
+		Consistently(written).ShouldNot(Receive())
+
+		Expect(peer.Write(&WindowUpdate{StreamId: 1, DeltaWindowSize: 500})).To(Succeed())
+		Expect(readFrame(peer).(*DataFrame).Data).To(HaveLen(500))
+		Eventually(written).Should(Receive(Equal(500)))
+	})
+
+	It("should grow open streams' windows", func() {
+		setInitialWindow(defaultInitialWindowSize * 2)
+		Eventually(sendWindow(stream)).Should(Equal(int32(defaultInitialWindowSize * 2)))
+	})
+
+	It("should start new streams with the new size", func() {
+		setInitialWindow(1000)
+		Eventually(sendWindow(stream)).Should(Equal(int32(1000)))
+
+		go session.OpenStream(NameValuePairs{})
+		readFrame(peer)
+		Expect(sendWindow(session.getStream(3))()).To(Equal(int32(1000)))
+	})
+})
+
+var _ = Describe("Session flow control", func() {
+	var (
+		session *Session
+		peer    *Framer
+		streams []*Stream
+	)
+
+	BeforeEach(func() {
+		session, peer = newPeer(false, &Config{Version: Spdy31})
+		streams = nil
+		for _, id := range []uint32{1, 3} {
+			go session.OpenStream(NameValuePairs{})
+			readFrame(peer)
+			streams = append(streams, session.getStream(id))
+			Expect(peer.Write(&SynReply{StreamId: id, Headers: NameValuePairs{}})).To(Succeed())
+		}
+	})
+
+	AfterEach(func() {
+		session.Close()
+	})
+
+	readData := func(n int) {
+		for n > 0 {
+			n -= len(readFrame(peer).(*DataFrame).Data)
+		}
+		Expect(n).To(Equal(0))
+	}
+
+	It("should speak SPDY/3.1", func() {
+		Expect(session.Version()).To(Equal(Spdy31))
+	})
+
+	It("should block writers once the session window is used up", func() {
+		Expect(peer.Write(&WindowUpdate{StreamId: 1, DeltaWindowSize: 10})).To(Succeed())
+		written := make(chan int, 2)
+		go func() {
+			n, _ := streams[0].Write(make([]byte, defaultInitialWindowSize+10))
+			written <- n
+		}()
+
+		readData(defaultInitialWindowSize)
+		Consistently(written).ShouldNot(Receive())
+
+		Expect(peer.Write(&WindowUpdate{StreamId: 0, DeltaWindowSize: 10})).To(Succeed())
+		readData(10)
+		Eventually(written).Should(Receive(Equal(defaultInitialWindowSize + 10)))
+	})
+
+	It("should share the session window between streams", func() {
+		go streams[0].Write(make([]byte, 40000))
+		readData(40000)
+
+		written := make(chan int, 1)
+		go func() {
+			n, _ := streams[1].Write(make([]byte, 40000))
+			written <- n
+		}()
+		readData(defaultInitialWindowSize - 40000)
+		Consistently(written).ShouldNot(Receive())
+
+		Expect(peer.Write(&WindowUpdate{StreamId: 0, DeltaWindowSize: 40000})).To(Succeed())
+		readData(40000 - (defaultInitialWindowSize - 40000))
+		Eventually(written).Should(Receive(Equal(40000)))
+	})
+
+	It("should open the session window as data is read from any stream", func() {
+		for _, stream := range streams {
+			Expect(peer.Write(&DataFrame{
+				StreamId: stream.Id(),
+				Data:     make([]byte, 20000),
+			})).To(Succeed())
+		}
+
+		go func() {
+			defer GinkgoRecover()
+			for _, stream := range streams {
+				Expect(io.ReadFull(stream, make([]byte, 20000))).To(Equal(20000))
+			}
+		}()
+		Expect(readFrame(peer)).To(Equal(&WindowUpdate{
+			StreamId:        0,
+			DeltaWindowSize: 40000,
+		}))
+	})
+
+	It("should hand back data which no stream takes", func() {
+		Expect(peer.Write(&DataFrame{
+			StreamId: 99,
+			Data:     make([]byte, 40000),
+		})).To(Succeed())
+		Expect(readFrame(peer)).To(Equal(&WindowUpdate{
+			StreamId:        0,
+			DeltaWindowSize: 40000,
+		}))
+		Expect(readFrame(peer)).To(Equal(&RstStream{
+			StreamId:   99,
+			StatusCode: InvalidStream,
+		}))
+	})
+
+	It("should end the session when the session window is overrun", func() {
+		for _, stream := range streams {
+			Expect(peer.Write(&DataFrame{
+				StreamId: stream.Id(),
+				Data:     make([]byte, 40000),
+			})).To(Succeed())
+		}
+		frame := readFrame(peer).(*GoAway)
+		Expect(frame.StatusCode).To(Equal(GoAwayProtocolError))
+		Eventually(session.Closed()).Should(BeClosed())
+	})
+
+	It("should end the session when the session window overflows", func() {
+		Expect(peer.Write(&WindowUpdate{
+			StreamId:        0,
+			DeltaWindowSize: maxWindowSize,
+		})).To(Succeed())
+		frame := readFrame(peer).(*GoAway)
+		Expect(frame.StatusCode).To(Equal(GoAwayProtocolError))
+	})
+
+	It("should have no session window under SPDY/3", func() {
+		session.Close()
+		session, peer = newPeer(false, nil)
+		go session.OpenStream(NameValuePairs{})
+		readFrame(peer)
+		Expect(peer.Write(&SynReply{StreamId: 1, Headers: NameValuePairs{}})).To(Succeed())
+		Expect(peer.Write(&WindowUpdate{StreamId: 0, DeltaWindowSize: maxWindowSize})).To(Succeed())
+		Expect(peer.Write(&WindowUpdate{StreamId: 1, DeltaWindowSize: 10})).To(Succeed())
+
+		go session.getStream(1).Write(make([]byte, defaultInitialWindowSize+10))
+		readData(defaultInitialWindowSize + 10)
+	})
+})
+
+var _ = Describe("Server push", func() {
+	var (
+		client, server *Session
+		stream, peer   *Stream
+		pushes         chan *Stream
+		pushStatus     RstStreamStatus
+	)
+
+	BeforeEach(func() {
+		pushes = make(chan *Stream, 1)
+		pushStatus = 0
+		config := &Config{
+			PushHandler: func(associated, pushed *Stream) RstStreamStatus {
+				pushes <- pushed
+				return pushStatus
+			},
+		}
+
+		var err error
+		client, server = newSessionPair(config, nil)
+		stream, err = client.OpenStream(NameValuePairs{":path": {"/"}})
+		Expect(err).To(BeNil())
+		peer, err = server.AcceptStream()
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		client.Close()
+		server.Close()
+	})
+
+	It("should push streams to the client", func() {
+		pushed, err := peer.Push(NameValuePairs{":path": {"/style.css"}})
+		Expect(err).To(BeNil())
+		Expect(pushed.AssociatedStreamId()).To(Equal(uint32(1)))
+		go func() {
+			defer GinkgoRecover()
+			pushed.Write([]byte("body {}"))
+			pushed.Close()
+		}()
+
+		var received *Stream
+		Eventually(pushes).Should(Receive(&received))
+		Expect(received.Id()).To(Equal(pushed.Id()))
+		Expect(received.AssociatedStreamId()).To(Equal(uint32(1)))
+		Expect(received.Headers()).To(Equal(NameValuePairs{":path": {"/style.css"}}))
+		Expect(ioutil.ReadAll(received)).To(Equal([]byte("body {}")))
+
+		_, err = received.Write([]byte("?"))
+		Expect(err).To(Equal(ErrWriteClosed))
+	})
+
+	It("should reset pushes the client rejects", func() {
+		pushStatus = Cancel
+		pushed, err := peer.Push(NameValuePairs{":path": {"/style.css"}})
+		Expect(err).To(BeNil())
+
+		Eventually(func() error {
+			_, err = pushed.Write([]byte("body {}"))
+			return err
+		}).Should(BeAssignableToTypeOf(&StreamError{}))
+		Expect(err.(*StreamError).StatusCode).To(Equal(Cancel))
+	})
+
+	It("should only push from a server on a client's stream", func() {
+		_, err := stream.Push(NameValuePairs{})
+		Expect(err).To(Equal(ErrCannotPush))
+
+		own, err := server.OpenStream(NameValuePairs{})
+		Expect(err).To(BeNil())
+		_, err = own.Push(NameValuePairs{})
+		Expect(err).To(Equal(ErrCannotPush))
+	})
+
+	It("should not push once the stream is closed for writing", func() {
+		Expect(peer.CloseWrite()).To(Succeed())
+		_, err := peer.Push(NameValuePairs{})
+		Expect(err).To(Equal(ErrWriteClosed))
+	})
+})
+
+var _ = Describe("Receiving pushes", func() {
+	var (
+		session *Session
+		peer    *Framer
+	)
+
+	BeforeEach(func() {
+		session, peer = newPeer(false, nil)
+		go session.OpenStream(NameValuePairs{})
+		readFrame(peer)
+	})
+
+	AfterEach(func() {
+		session.Close()
+	})
+
+	It("should pass pushed streams to AcceptStream without a handler", func() {
+		Expect(peer.Write(&SynStream{
+			Flags:              FlagUnidirectional,
+			StreamId:           2,
+			AssociatedStreamId: 1,
+			Headers:            NameValuePairs{},
+		})).To(Succeed())
+
+		pushed, err := session.AcceptStream()
+		Expect(err).To(BeNil())
+		Expect(pushed.AssociatedStreamId()).To(Equal(uint32(1)))
+	})
+
+	It("should refuse pushes which are not unidirectional", func() {
+		Expect(peer.Write(&SynStream{
+			StreamId:           2,
+			AssociatedStreamId: 1,
+			Headers:            NameValuePairs{},
+		})).To(Succeed())
+		Expect(readFrame(peer)).To(Equal(&RstStream{
+			StreamId:   2,
+			StatusCode: ProtocolError,
+		}))
+	})
+
+	It("should refuse pushes after the associated stream has closed", func() {
+		Expect(peer.Write(&SynReply{
+			Flags:    FlagFin,
+			StreamId: 1,
+			Headers:  NameValuePairs{},
+		})).To(Succeed())
+		Expect(peer.Write(&SynStream{
+			Flags:              FlagUnidirectional,
+			StreamId:           2,
+			AssociatedStreamId: 1,
+			Headers:            NameValuePairs{},
+		})).To(Succeed())
+		Expect(readFrame(peer)).To(Equal(&RstStream{
+			StreamId:   2,
+			StatusCode: InvalidStream,
+		}))
+	})
+})
@@ -0,0 +1,189 @@
+package spdy3
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrNoSpdy = errors.New("TLS peer did not agree to speak SPDY")
+
+// How long a Server waits for a client to finish its TLS handshake, unless
+// told otherwise.
+const defaultHandshakeTimeout = 10 * time.Second
+
+// A NoSpdyError is returned by DialTLS when the server does not pick SPDY. It
+// holds the connection, which is left open with its handshake done so it can be
+// used for HTTP/1.1. It is ErrNoSpdy as far as errors.Is is concerned.
+type NoSpdyError struct {
+	Conn *tls.Conn
+}
+
+func (e *NoSpdyError) Error() string {
+	return ErrNoSpdy.Error()
+}
+
+func (e *NoSpdyError) Unwrap() error {
+	return ErrNoSpdy
+}
+
+// The ALPN protocol names of the versions of SPDY we speak, and the one we
+// fall back on.
+const (
+	NextProtoSpdy31 = "spdy/3.1"
+	NextProtoSpdy3  = "spdy/3"
+	NextProtoSpdy2  = "spdy/2"
+	NextProtoHTTP1  = "http/1.1"
+)
+
+// The version of SPDY each ALPN protocol name stands for, in order of
+// preference.
+var nextProtos = []struct {
+	name    string
+	version SpdyVersion
+}{
+	{NextProtoSpdy31, Spdy31},
+	{NextProtoSpdy3, Spdy3},
+	{NextProtoSpdy2, Spdy2},
+}
+
+// negotiatedVersion returns the version of SPDY picked during a TLS handshake,
+// if any was.
+func negotiatedVersion(conn *tls.Conn) (SpdyVersion, bool) {
+	proto := conn.ConnectionState().NegotiatedProtocol
+	for _, p := range nextProtos {
+		if p.name == proto {
+			return p.version, true
+		}
+	}
+	return 0, false
+}
+
+// tlsConfig returns a copy of config which offers SPDY ahead of HTTP/1.1 and
+// any protocols it already had.
+func tlsConfig(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = new(tls.Config)
+	} else {
+		config = config.Clone()
+	}
+
+	var protos []string
+	for _, p := range nextProtos {
+		protos = append(protos, p.name)
+	}
+	protos = append(protos, NextProtoHTTP1)
+	for _, proto := range config.NextProtos {
+		if !containsString(protos, proto) {
+			protos = append(protos, proto)
+		}
+	}
+	config.NextProtos = protos
+	return config
+}
+
+// ListenTLS listens for TLS connections on addr, offering clients SPDY ahead
+// of HTTP/1.1. A Server serving the listener falls back on HTTP/1.1 for
+// clients which do not pick SPDY.
+func ListenTLS(network, addr string, config *tls.Config) (net.Listener, error) {
+	return tls.Listen(network, addr, tlsConfig(config))
+}
+
+// DialTLS connects to addr over TLS, and starts a client session if the server
+// picks SPDY. If it does not, a *NoSpdyError is returned holding the open
+// connection, for the caller to speak HTTP/1.1 over or close.
+func DialTLS(network, addr string, tlsConf *tls.Config, config *Config) (*Session, error) {
+	return dialTLS(context.Background(), network, addr, tlsConf, config)
+}
+
+func dialTLS(ctx context.Context, network, addr string, tlsConf *tls.Config, config *Config) (*Session, error) {
+	dialer := &tls.Dialer{Config: tlsConfig(tlsConf)}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := conn.(*tls.Conn)
+	version, ok := negotiatedVersion(tlsConn)
+	if !ok {
+		return nil, &NoSpdyError{Conn: tlsConn}
+	}
+	return NewSession(tlsConn, false, withVersion(config, version)), nil
+}
+
+// withVersion returns a copy of config which speaks version.
+func withVersion(config *Config, version SpdyVersion) *Config {
+	config = config.withDefaults()
+	config.Version = version
+	return config
+}
+
+// ----------------------------------------------------------------------------
+// HTTP/1.1 Fallback
+//
+// A fallbackListener hands connections which did not negotiate SPDY to an
+// http.Server, which serves them as HTTP/1.1.
+type fallbackListener struct {
+	addr   net.Addr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newFallbackListener(addr net.Addr) *fallbackListener {
+	return &fallbackListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// serve passes conn to the http.Server, or closes it if the listener has been
+// closed.
+func (l *fallbackListener) serve(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *fallbackListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *fallbackListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *fallbackListener) Addr() net.Addr {
+	return l.addr
+}
+
+// serveFallback serves HTTP/1.1 with handler on the connections of l until it
+// is closed.
+func serveFallback(l *fallbackListener, handler http.Handler) {
+	server := &http.Server{Handler: handler}
+	server.Serve(l)
+}
+
+func containsString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
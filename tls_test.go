@@ -0,0 +1,239 @@
+package spdy3
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// selfSigned makes a certificate for 127.0.0.1, and a pool which trusts it.
+func selfSigned() (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"spdy3 test"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).To(BeNil())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).To(BeNil())
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+var _ = Describe("TLS", func() {
+	var (
+		cert      tls.Certificate
+		pool      *x509.CertPool
+		listener  net.Listener
+		addr      string
+		requests  chan *http.Request
+		transport *Transport
+	)
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		fmt.Fprintf(w, "hello over %s", r.Proto)
+	}
+
+	BeforeEach(func() {
+		cert, pool = selfSigned()
+		requests = make(chan *http.Request, 1)
+
+		var err error
+		listener, err = ListenTLS("tcp", "127.0.0.1:0", &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		})
+		Expect(err).To(BeNil())
+		addr = listener.Addr().String()
+
+		server := &Server{Handler: http.HandlerFunc(handler)}
+		go server.Serve(listener)
+
+		transport = &Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	})
+
+	AfterEach(func() {
+		transport.CloseIdleConnections()
+		listener.Close()
+	})
+
+	It("should offer SPDY ahead of HTTP/1.1", func() {
+		config := tlsConfig(&tls.Config{NextProtos: []string{"h2", "http/1.1"}})
+		Expect(config.NextProtos).To(Equal([]string{"spdy/3.1", "spdy/3", "spdy/2", "http/1.1", "h2"}))
+	})
+
+	It("should speak SPDY when both ends offer it", func() {
+		session, err := DialTLS("tcp", addr, &tls.Config{RootCAs: pool}, nil)
+		Expect(err).To(BeNil())
+		defer session.Close()
+		Expect(session.Version()).To(Equal(Spdy31))
+
+		stream, err := session.OpenStream(NameValuePairs{
+			":method":  {"GET"},
+			":path":    {"/"},
+			":version": {"HTTP/1.1"},
+			":scheme":  {"https"},
+			":host":    {addr},
+		})
+		Expect(err).To(BeNil())
+		Expect(stream.CloseWrite()).To(Succeed())
+
+		reply, err := stream.ReplyHeaders()
+		Expect(err).To(BeNil())
+		Expect(reply.Get(":status")).To(Equal("200 OK"))
+		Expect(ioutil.ReadAll(stream)).To(Equal([]byte("hello over HTTP/1.1")))
+
+		var r *http.Request
+		Eventually(requests).Should(Receive(&r))
+		Expect(r.TLS).NotTo(BeNil())
+		Expect(r.TLS.NegotiatedProtocol).To(Equal(NextProtoSpdy31))
+	})
+
+	It("should speak SPDY/3 to clients which do not offer SPDY/3.1", func() {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{
+			RootCAs:    pool,
+			NextProtos: []string{NextProtoSpdy3},
+		})
+		Expect(err).To(BeNil())
+		Expect(conn.ConnectionState().NegotiatedProtocol).To(Equal(NextProtoSpdy3))
+
+		session := NewSession(conn, false, nil)
+		defer session.Close()
+		stream, err := session.OpenStream(NameValuePairs{
+			":method":  {"GET"},
+			":path":    {"/"},
+			":version": {"HTTP/1.1"},
+			":scheme":  {"https"},
+			":host":    {addr},
+		})
+		Expect(err).To(BeNil())
+		Expect(stream.CloseWrite()).To(Succeed())
+		Expect(ioutil.ReadAll(stream)).To(Equal([]byte("hello over HTTP/1.1")))
+	})
+
+	It("should serve HTTP/1.1 to clients which do not speak SPDY", func() {
+		client := &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		}
+		resp, err := client.Get("https://" + addr + "/")
+		Expect(err).To(BeNil())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(200))
+		Expect(ioutil.ReadAll(resp.Body)).To(Equal([]byte("hello over HTTP/1.1")))
+
+		var r *http.Request
+		Eventually(requests).Should(Receive(&r))
+		Expect(r.TLS.NegotiatedProtocol).NotTo(HavePrefix("spdy/"))
+	})
+
+	It("should not start a session with servers which do not speak SPDY", func() {
+		server := httptest.NewTLSServer(http.HandlerFunc(handler))
+		defer server.Close()
+
+		_, err := DialTLS("tcp", server.Listener.Addr().String(), server.Client().Transport.(*http.Transport).TLSClientConfig, nil)
+		Expect(errors.Is(err, ErrNoSpdy)).To(BeTrue())
+
+		// The connection is handed back ready for HTTP/1.1
+		conn := err.(*NoSpdyError).Conn
+		defer conn.Close()
+		Expect(conn.ConnectionState().NegotiatedProtocol).To(Equal(NextProtoHTTP1))
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		Expect(err).To(BeNil())
+		defer resp.Body.Close()
+		Expect(ioutil.ReadAll(resp.Body)).To(Equal([]byte("hello over HTTP/1.1")))
+	})
+
+	It("should close connections which do not finish their handshake", func() {
+		l, err := ListenTLS("tcp", "127.0.0.1:0", &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		})
+		Expect(err).To(BeNil())
+		defer l.Close()
+		server := &Server{HandshakeTimeout: 50 * time.Millisecond}
+		go server.Serve(l)
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		Expect(err).To(BeNil())
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		Expect(err).To(Equal(io.EOF))
+	})
+
+	It("should send requests over SPDY with a Transport", func() {
+		client := &http.Client{Transport: transport}
+		resp, err := client.Get("https://" + addr + "/")
+		Expect(err).To(BeNil())
+		defer resp.Body.Close()
+		Expect(ioutil.ReadAll(resp.Body)).To(Equal([]byte("hello over HTTP/1.1")))
+
+		var r *http.Request
+		Eventually(requests).Should(Receive(&r))
+		Expect(r.TLS.NegotiatedProtocol).To(Equal(NextProtoSpdy31))
+	})
+
+	It("should fall back on HTTP/1.1 with a Transport", func() {
+		var mu sync.Mutex
+		conns := 0
+		server := httptest.NewUnstartedServer(http.HandlerFunc(handler))
+		server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+			mu.Lock()
+			defer mu.Unlock()
+			if state == http.StateNew {
+				conns++
+			}
+		}
+		server.StartTLS()
+		defer server.Close()
+		transport.TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+
+		client := &http.Client{Transport: transport}
+		for i := 0; i < 2; i++ {
+			resp, err := client.Get(server.URL + "/")
+			Expect(err).To(BeNil())
+			Expect(ioutil.ReadAll(resp.Body)).To(Equal([]byte("hello over HTTP/1.1")))
+			resp.Body.Close()
+			Eventually(requests).Should(Receive())
+		}
+
+		key := "https://" + server.Listener.Addr().String()
+		Expect(transport.speaksSpdy(key)).To(BeFalse())
+
+		// The connection which turned out not to speak SPDY was used for
+		// HTTP/1.1, rather than a second one dialed
+		mu.Lock()
+		defer mu.Unlock()
+		Expect(conns).To(Equal(1))
+	})
+})
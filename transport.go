@@ -0,0 +1,591 @@
+package spdy3
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// How many times a request is retried after the server turns it away unseen.
+const maxRetries = 3
+
+// ----------------------------------------------------------------------------
+// HTTP Transport
+//
+// A Transport is an http.RoundTripper which sends requests over SPDY. It keeps
+// a pool of sessions for each host, and each request is a stream on one of
+// them. A request the server turned away without processing, with a GOAWAY or
+// REFUSED_STREAM, is retried on a fresh session.
+//
+// Requests for https URLs offer the server SPDY while setting up TLS. Hosts
+// which do not pick it are sent requests over HTTP/1.1 from then on.
+type Transport struct {
+	// DialContext opens the connection for a new session to addr, which is a
+	// "host:port". Without it http URLs use plain TCP, and https URLs TLS set
+	// up with TLSClientConfig.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// The TLS configuration for https URLs, if DialContext is not set.
+	TLSClientConfig *tls.Config
+
+	// Fallback makes requests to hosts which do not speak SPDY. Without it an
+	// http.Transport with the same TLSClientConfig is used, which starts with
+	// the connection that found the host does not speak SPDY.
+	Fallback http.RoundTripper
+
+	// The configuration each session is started with. If it has a
+	// SettingsStore but no Origin, each session uses the origin it connects
+	// to. Without a PushHandler, pushed streams are cancelled.
+	Config *Config
+
+	// Requests for a host with no session to spare wait on the one dial in
+	// progress for it, in dialing, rather than each dialing their own.
+	mu       sync.Mutex
+	sessions map[string][]*Session
+	dialing  map[string]*dialCall
+	noSpdy   map[string]bool
+	fallback http.RoundTripper
+
+	// TLS connections to hosts which picked HTTP/1.1 rather than SPDY, by
+	// "host:port", waiting to be taken up by the fallback transport.
+	http1Conns map[string][]*tls.Conn
+}
+
+// A dialCall is a new session being dialed. Once done is closed, it holds the
+// session or the reason there is none.
+type dialCall struct {
+	ctx     context.Context
+	done    chan struct{}
+	session *Session
+	err     error
+}
+
+// RoundTrip sends a request on a stream of one of the host's sessions, and
+// returns its response once the server has replied. The response body reads
+// the rest of the stream.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		closeBody(req)
+		return nil, fmt.Errorf("spdy3: unsupported protocol scheme %q", req.URL.Scheme)
+	}
+	if req.URL.Host == "" {
+		closeBody(req)
+		return nil, errors.New("spdy3: no host in request URL")
+	}
+
+	key := req.URL.Scheme + "://" + hostPort(req.URL.Scheme, req.URL.Host)
+	if !t.speaksSpdy(key) {
+		return t.fallbackTransport().RoundTrip(req)
+	}
+
+	var avoid *Session
+	for retries := 0; ; retries++ {
+		session, err := t.getSession(req, key, avoid)
+		if err == ErrNoSpdy {
+			t.mu.Lock()
+			t.noSpdy[key] = true
+			t.mu.Unlock()
+			return t.fallbackTransport().RoundTrip(req)
+		}
+		if err != nil {
+			closeBody(req)
+			return nil, err
+		}
+
+		resp, err := t.roundTrip(session, req)
+		if err == nil {
+			return resp, nil
+		}
+		closeBody(req)
+		if retries == maxRetries || !retryable(err) {
+			return nil, err
+		}
+
+		if req, err = rewindBody(req); err != nil {
+			return nil, err
+		}
+		avoid = session
+	}
+}
+
+// speaksSpdy is false for hosts known not to speak SPDY.
+func (t *Transport) speaksSpdy(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.noSpdy[key]
+}
+
+func (t *Transport) fallbackTransport() http.RoundTripper {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.Fallback != nil {
+		return t.Fallback
+	}
+	if t.fallback == nil {
+		t.fallback = &http.Transport{
+			TLSClientConfig: t.TLSClientConfig,
+			DialTLSContext:  t.dialHTTP1,
+		}
+	}
+	return t.fallback
+}
+
+// keepHTTP1Conn holds on to a connection which negotiated HTTP/1.1, for the
+// fallback transport to use. A Fallback of the caller's cannot be handed it.
+func (t *Transport) keepHTTP1Conn(addr string, conn *tls.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.Fallback != nil {
+		conn.Close()
+		return
+	}
+	if t.http1Conns == nil {
+		t.http1Conns = make(map[string][]*tls.Conn)
+	}
+	t.http1Conns[addr] = append(t.http1Conns[addr], conn)
+}
+
+// dialHTTP1 gives the fallback transport a connection to addr, taking one
+// already made if there is any. New connections only offer HTTP/1.1.
+func (t *Transport) dialHTTP1(ctx context.Context, network, addr string) (net.Conn, error) {
+	t.mu.Lock()
+	if conns := t.http1Conns[addr]; len(conns) > 0 {
+		conn := conns[0]
+		t.http1Conns[addr] = conns[1:]
+		if len(t.http1Conns[addr]) == 0 {
+			delete(t.http1Conns, addr)
+		}
+		t.mu.Unlock()
+		return conn, nil
+	}
+	t.mu.Unlock()
+
+	config := new(tls.Config)
+	if t.TLSClientConfig != nil {
+		config = t.TLSClientConfig.Clone()
+	}
+	config.NextProtos = []string{NextProtoHTTP1}
+	dialer := &tls.Dialer{Config: config}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// CloseIdleConnections closes every session with no requests in progress, as
+// well as the idle connections of the fallback transport.
+func (t *Transport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+	fallback := t.Fallback
+	if fallback == nil {
+		fallback = t.fallback
+	}
+	if c, ok := fallback.(closeIdler); ok {
+		c.CloseIdleConnections()
+	}
+	for addr, conns := range t.http1Conns {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		delete(t.http1Conns, addr)
+	}
+
+	for key, sessions := range t.sessions {
+		var busy []*Session
+		for _, session := range sessions {
+			if session.idle() {
+				session.Close()
+			} else {
+				busy = append(busy, session)
+			}
+		}
+		t.sessions[key] = busy
+	}
+}
+
+func (t *Transport) roundTrip(session *Session, req *http.Request) (*http.Response, error) {
+	var flags uint8
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	if !hasBody {
+		flags = FlagFin
+	}
+
+	stream, err := session.openStream(requestHeaders(req), 0, 0, flags, nil)
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+
+	// Give up on the stream if the request is cancelled before the response
+	// has been read. One which has finished has nothing left to reset.
+	ctx := req.Context()
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			if stream.State() != StreamClosed {
+				stream.Reset(Cancel)
+			}
+		case <-done:
+		}
+	}()
+
+	if hasBody {
+		go func() {
+			defer req.Body.Close()
+			if _, err := io.Copy(stream, req.Body); err != nil {
+				stream.Reset(Cancel)
+				return
+			}
+			stream.CloseWrite()
+		}()
+	}
+
+	// Trailers may already have arrived, and are left for the body to find
+	reply, err := stream.waitForReply(false)
+	if err != nil {
+		close(done)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	resp, err := newResponse(req, reply)
+	if err != nil {
+		close(done)
+		stream.Reset(ProtocolError)
+		return nil, err
+	}
+	resp.Body = &responseBody{
+		stream: stream,
+		resp:   resp,
+		reply:  reply,
+		done:   done,
+	}
+	return resp, nil
+}
+
+// getSession finds a session to the request's host which can take another
+// stream, starting a new one if there are none. Requests which arrive while a
+// session is being dialed wait to share it. The avoid session is never picked,
+// so a request it turned away can be retried elsewhere.
+func (t *Transport) getSession(req *http.Request, key string, avoid *Session) (*Session, error) {
+	ctx := req.Context()
+	for {
+		t.mu.Lock()
+		if t.sessions == nil {
+			t.sessions = make(map[string][]*Session)
+			t.dialing = make(map[string]*dialCall)
+			t.noSpdy = make(map[string]bool)
+		}
+		for _, session := range t.sessions[key] {
+			if session != avoid && session.available() {
+				t.mu.Unlock()
+				return session, nil
+			}
+		}
+
+		call, waiting := t.dialing[key]
+		if !waiting {
+			call = &dialCall{ctx: ctx, done: make(chan struct{})}
+			t.dialing[key] = call
+		}
+		t.mu.Unlock()
+
+		if !waiting {
+			return t.dialSession(call, key, req.URL.Scheme, req.URL.Host)
+		}
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// A dial given up on by the request which started it is no reason for
+		// the others to fail, so they look again
+		if call.err != nil && call.ctx.Err() == nil {
+			return nil, call.err
+		}
+	}
+}
+
+// dialSession makes the dial of a call, and adds its session to the host's pool
+// for as long as it can take new streams.
+func (t *Transport) dialSession(call *dialCall, key, scheme, host string) (*Session, error) {
+	call.session, call.err = t.dial(call.ctx, scheme, host)
+	var noSpdy *NoSpdyError
+	if errors.As(call.err, &noSpdy) {
+		t.keepHTTP1Conn(hostPort(scheme, host), noSpdy.Conn)
+		call.err = ErrNoSpdy
+	}
+
+	t.mu.Lock()
+	delete(t.dialing, key)
+	if call.err == nil {
+		t.sessions[key] = append(t.sessions[key], call.session)
+	}
+	t.mu.Unlock()
+	close(call.done)
+
+	if call.err != nil {
+		return nil, call.err
+	}
+	go t.watchSession(key, call.session)
+	return call.session, nil
+}
+
+// watchSession takes a session out of the pool once it closes, or once the
+// server sends a GOAWAY. A session which has gone away is closed as soon as
+// its last streams are done.
+func (t *Transport) watchSession(key string, session *Session) {
+	select {
+	case <-session.Closed():
+	case <-session.goneAway:
+	}
+	t.removeSession(key, session)
+	session.Shutdown(context.Background())
+}
+
+func (t *Transport) removeSession(key string, session *Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sessions := t.sessions[key]
+	for i := range sessions {
+		if sessions[i] == session {
+			t.sessions[key] = append(sessions[:i:i], sessions[i+1:]...)
+			break
+		}
+	}
+	if len(t.sessions[key]) == 0 {
+		delete(t.sessions, key)
+	}
+}
+
+func (t *Transport) dial(ctx context.Context, scheme, host string) (*Session, error) {
+	addr := hostPort(scheme, host)
+	config := t.Config.withDefaults()
+	if config.SettingsStore != nil && config.Origin == "" {
+		config.Origin = scheme + "://" + addr
+	}
+	if config.PushHandler == nil {
+		// Nothing accepts the session's streams, so a push would sit unread
+		// holding on to its share of the window
+		config.PushHandler = cancelPush
+	}
+
+	dial := t.DialContext
+	if dial == nil {
+		if scheme == "https" {
+			return dialTLS(ctx, "tcp", addr, t.TLSClientConfig, config)
+		}
+		dial = new(net.Dialer).DialContext
+	}
+
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSession(conn, false, config), nil
+}
+
+func cancelPush(associated, pushed *Stream) RstStreamStatus {
+	return Cancel
+}
+
+// requestHeaders turns a request into the headers of the SYN_STREAM which
+// carries it.
+func requestHeaders(req *http.Request) NameValuePairs {
+	headers := make(NameValuePairs)
+	for name, values := range req.Header {
+		if hopByHopHeaders[name] || name == "Host" {
+			continue
+		}
+		for _, value := range values {
+			headers.Add(name, value)
+		}
+	}
+
+	method := req.Method
+	if method == "" {
+		method = "GET"
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers.Set(":method", method)
+	headers.Set(":path", req.URL.RequestURI())
+	headers.Set(":version", "HTTP/1.1")
+	headers.Set(":host", host)
+	headers.Set(":scheme", req.URL.Scheme)
+	if req.ContentLength > 0 {
+		headers.Set("content-length", strconv.FormatInt(req.ContentLength, 10))
+	}
+	return headers
+}
+
+// newResponse builds a response from the headers of a SYN_REPLY. Its body is
+// left for the caller.
+func newResponse(req *http.Request, reply NameValuePairs) (*http.Response, error) {
+	status := reply.Get(":status")
+	code, err := strconv.Atoi(strings.SplitN(status, " ", 2)[0])
+	if err != nil || code < 100 || code > 999 {
+		return nil, fmt.Errorf("spdy3: bad response status %q", status)
+	}
+
+	version := reply.Get(":version")
+	major, minor, ok := http.ParseHTTPVersion(version)
+	if !ok {
+		return nil, fmt.Errorf("spdy3: bad response version %q", version)
+	}
+
+	resp := &http.Response{
+		Status:        status,
+		StatusCode:    code,
+		Proto:         version,
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        make(http.Header),
+		ContentLength: -1,
+		Request:       req,
+	}
+	if !strings.Contains(status, " ") {
+		resp.Status = status + " " + http.StatusText(code)
+	}
+
+	for name, values := range reply {
+		if !strings.HasPrefix(name, ":") {
+			resp.Header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	if length := resp.Header.Get("Content-Length"); length != "" {
+		if resp.ContentLength, err = strconv.ParseInt(length, 10, 64); err != nil {
+			return nil, fmt.Errorf("spdy3: bad Content-Length %q", length)
+		}
+	}
+	for _, value := range resp.Header["Trailer"] {
+		for _, name := range strings.Split(value, ",") {
+			if resp.Trailer == nil {
+				resp.Trailer = make(http.Header)
+			}
+			resp.Trailer[http.CanonicalHeaderKey(strings.TrimSpace(name))] = nil
+		}
+	}
+	return resp, nil
+}
+
+// retryable is true for errors which mean the server turned a request away
+// without processing it.
+func retryable(err error) bool {
+	var streamErr *StreamError
+	if errors.As(err, &streamErr) {
+		return streamErr.StatusCode == RefusedStream
+	}
+	return err == ErrGoAway || err == ErrTooManyStreams
+}
+
+// rewindBody returns a copy of the request ready to be sent again.
+func rewindBody(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	if req.GetBody == nil {
+		return nil, errors.New("spdy3: cannot retry a request whose body cannot be rewound")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	retry := *req
+	retry.Body = body
+	return &retry, nil
+}
+
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+// hostPort adds the scheme's default port to host if it has none.
+func hostPort(scheme, host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	if scheme == "https" {
+		return net.JoinHostPort(host, "443")
+	}
+	return net.JoinHostPort(host, "80")
+}
+
+// ----------------------------------------------------------------------------
+// Response Body
+//
+// A responseBody reads the rest of a response's stream. Any HEADERS frames
+// which arrived along with the body are its trailers. Closing the body before
+// the end resets the stream. Closing done, once the body has been read or
+// closed, stops the request's cancellation from resetting the stream.
+type responseBody struct {
+	stream   *Stream
+	resp     *http.Response
+	reply    NameValuePairs
+	done     chan struct{}
+	doneOnce sync.Once
+	once     sync.Once
+}
+
+func (b *responseBody) Read(p []byte) (int, error) {
+	n, err := b.stream.Read(p)
+	if err == io.EOF {
+		b.readTrailers()
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *responseBody) finish() {
+	b.doneOnce.Do(func() {
+		close(b.done)
+	})
+}
+
+func (b *responseBody) readTrailers() {
+	headers, err := b.stream.ReplyHeaders()
+	if err != nil {
+		return
+	}
+	for name, values := range headers {
+		if strings.HasPrefix(name, ":") || len(values) <= len(b.reply[name]) {
+			continue
+		}
+		if b.resp.Trailer == nil {
+			b.resp.Trailer = make(http.Header)
+		}
+		b.resp.Trailer[http.CanonicalHeaderKey(name)] = values[len(b.reply[name]):]
+	}
+	b.reply = headers
+}
+
+func (b *responseBody) Close() error {
+	b.once.Do(func() {
+		b.finish()
+		if b.stream.State() == StreamClosed {
+			return
+		}
+		b.stream.Reset(Cancel)
+	})
+	return nil
+}
+
+// Ensure Transport is an http.RoundTripper
+var _ http.RoundTripper = &Transport{}
@@ -0,0 +1,386 @@
+package spdy3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Transport", func() {
+	var (
+		transport *Transport
+		client    *http.Client
+		handler   http.HandlerFunc
+
+		mu    sync.Mutex
+		dials int
+
+		// Connections are served by the peer functions in turn, and by the
+		// server once they run out.
+		peers []func(*Framer)
+	)
+
+	BeforeEach(func() {
+		dials = 0
+		peers = nil
+		server := &Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handler(w, r)
+			}),
+		}
+
+		transport = &Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				Expect(addr).To(Equal("example.com:80"))
+				conn, serverConn := net.Pipe()
+
+				mu.Lock()
+				defer mu.Unlock()
+				if dials < len(peers) {
+					go peers[dials](NewFramer(Spdy3, serverConn))
+				} else {
+					go server.ServeConn(serverConn)
+				}
+				dials++
+				return conn, nil
+			},
+		}
+		client = &http.Client{Transport: transport}
+	})
+
+	AfterEach(func() {
+		transport.CloseIdleConnections()
+	})
+
+	dialCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return dials
+	}
+
+	// refuse answers the first request on a connection with a frame from
+	// answer, leaving the connection open.
+	refuse := func(answer func(id uint32) Frame) func(*Framer) {
+		return func(peer *Framer) {
+			frame, err := peer.Read()
+			if err != nil {
+				return
+			}
+			peer.Write(answer(frame.(*SynStream).StreamId))
+			for {
+				if _, err := peer.Read(); err != nil {
+					return
+				}
+			}
+		}
+	}
+
+	It("should make requests", func() {
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.Host).To(Equal("example.com"))
+			Expect(r.URL.Path).To(Equal("/hello"))
+			Expect(r.Header.Get("X-Question")).To(Equal("6x9"))
+			w.Header().Set("X-Answer", "42")
+			w.WriteHeader(http.StatusTeapot)
+			fmt.Fprint(w, "hello")
+		}
+
+		req, _ := http.NewRequest("GET", "http://example.com/hello", nil)
+		req.Header.Set("X-Question", "6x9")
+		resp, err := client.Do(req)
+		Expect(err).To(BeNil())
+		defer resp.Body.Close()
+
+		Expect(resp.StatusCode).To(Equal(http.StatusTeapot))
+		Expect(resp.Status).To(Equal("418 I'm a teapot"))
+		Expect(resp.ProtoMajor).To(Equal(1))
+		Expect(resp.Header.Get("X-Answer")).To(Equal("42"))
+		Expect(ioutil.ReadAll(resp.Body)).To(Equal([]byte("hello")))
+	})
+
+	It("should send request bodies", func() {
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.ContentLength).To(Equal(int64(100000)))
+			io.Copy(w, r.Body)
+		}
+
+		body := bytes.Repeat([]byte("abcd"), 25000)
+		resp, err := client.Post("http://example.com/echo", "text/plain", bytes.NewReader(body))
+		Expect(err).To(BeNil())
+		defer resp.Body.Close()
+		Expect(ioutil.ReadAll(resp.Body)).To(Equal(body))
+	})
+
+	It("should read trailers", func() {
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Trailer", "X-Checksum")
+			fmt.Fprint(w, "body")
+			w.Header().Set("X-Checksum", "abc")
+		}
+
+		resp, err := client.Get("http://example.com/")
+		Expect(err).To(BeNil())
+		defer resp.Body.Close()
+		Expect(resp.Trailer).To(HaveKey("X-Checksum"))
+		Expect(resp.Trailer.Get("X-Checksum")).To(BeEmpty())
+
+		Expect(ioutil.ReadAll(resp.Body)).To(Equal([]byte("body")))
+		Expect(resp.Trailer.Get("X-Checksum")).To(Equal("abc"))
+	})
+
+	It("should share a session between requests", func() {
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, r.URL.Path)
+		}
+
+		for _, path := range []string{"/a", "/b", "/c"} {
+			resp, err := client.Get("http://example.com" + path)
+			Expect(err).To(BeNil())
+			Expect(ioutil.ReadAll(resp.Body)).To(Equal([]byte(path)))
+			resp.Body.Close()
+		}
+		Expect(dialCount()).To(Equal(1))
+	})
+
+	It("should cancel pushed streams", func() {
+		// The pushed requests are still being served after the responses
+		// they went with, so are waited for before the next spec's handler
+		var pushed sync.WaitGroup
+		defer pushed.Wait()
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/" {
+				Expect(w.(http.Pusher).Push("/style.css", nil)).To(Succeed())
+			} else {
+				defer pushed.Done()
+			}
+			fmt.Fprint(w, r.URL.Path)
+		}
+
+		pushed.Add(3)
+		for i := 0; i < 3; i++ {
+			resp, err := client.Get("http://example.com/")
+			Expect(err).To(BeNil())
+			Expect(ioutil.ReadAll(resp.Body)).To(Equal([]byte("/")))
+			resp.Body.Close()
+		}
+
+		transport.mu.Lock()
+		sessions := transport.sessions["http://example.com:80"]
+		transport.mu.Unlock()
+		Expect(sessions).To(HaveLen(1))
+		Expect(sessions[0].accept).To(BeEmpty())
+	})
+
+	It("should retry refused requests on a new session", func() {
+		peers = []func(*Framer){refuse(func(id uint32) Frame {
+			return &RstStream{StreamId: id, StatusCode: RefusedStream}
+		})}
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(w, r.Body)
+		}
+
+		resp, err := client.Post("http://example.com/", "text/plain", bytes.NewBufferString("again"))
+		Expect(err).To(BeNil())
+		defer resp.Body.Close()
+		Expect(ioutil.ReadAll(resp.Body)).To(Equal([]byte("again")))
+		Expect(dialCount()).To(Equal(2))
+	})
+
+	It("should retry requests the server went away before processing", func() {
+		peers = []func(*Framer){refuse(func(id uint32) Frame {
+			return &GoAway{LastGoodStreamId: 0}
+		})}
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "ok")
+		}
+
+		resp, err := client.Get("http://example.com/")
+		Expect(err).To(BeNil())
+		defer resp.Body.Close()
+		Expect(ioutil.ReadAll(resp.Body)).To(Equal([]byte("ok")))
+		Expect(dialCount()).To(Equal(2))
+	})
+
+	It("should close and forget sessions the server went away from", func() {
+		closed := make(chan struct{})
+		peers = []func(*Framer){func(peer *Framer) {
+			defer close(closed)
+			refuse(func(id uint32) Frame {
+				return &GoAway{LastGoodStreamId: 0}
+			})(peer)
+		}}
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "ok")
+		}
+
+		resp, err := client.Get("http://example.com/")
+		Expect(err).To(BeNil())
+		defer resp.Body.Close()
+		Expect(ioutil.ReadAll(resp.Body)).To(Equal([]byte("ok")))
+		Eventually(closed).Should(BeClosed())
+
+		transport.mu.Lock()
+		sessions := transport.sessions["http://example.com:80"]
+		transport.mu.Unlock()
+		Expect(sessions).To(HaveLen(1))
+		Expect(dialCount()).To(Equal(2))
+	})
+
+	It("should dial once for requests which arrive together", func() {
+		dial := transport.DialContext
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			time.Sleep(5 * time.Millisecond)
+			return dial(ctx, network, addr)
+		}
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "ok")
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				resp, err := client.Get("http://example.com/")
+				Expect(err).To(BeNil())
+				defer resp.Body.Close()
+				Expect(ioutil.ReadAll(resp.Body)).To(Equal([]byte("ok")))
+			}()
+		}
+		wg.Wait()
+		Expect(dialCount()).To(Equal(1))
+	})
+
+	It("should not retry other resets", func() {
+		peers = []func(*Framer){refuse(func(id uint32) Frame {
+			return &RstStream{StreamId: id, StatusCode: InternalError}
+		})}
+
+		_, err := client.Get("http://example.com/")
+		Expect(err).NotTo(BeNil())
+		Expect(dialCount()).To(Equal(1))
+	})
+
+	It("should close the body of a request it cannot send", func() {
+		conn, _ := net.Pipe()
+		session := NewSession(conn, false, nil)
+		session.Close()
+
+		body := &closeRecorder{Reader: bytes.NewBufferString("body")}
+		req, _ := http.NewRequest("POST", "http://example.com/", body)
+		_, err := transport.roundTrip(session, req)
+		Expect(err).NotTo(BeNil())
+		Expect(body.isClosed()).To(BeTrue())
+	})
+
+	It("should close the body of each attempt at a request", func() {
+		goAway := refuse(func(id uint32) Frame {
+			return &GoAway{LastGoodStreamId: 0}
+		})
+		peers = []func(*Framer){goAway, goAway, goAway, goAway}
+
+		var bodies []*closeRecorder
+		newBody := func() (io.ReadCloser, error) {
+			body := &closeRecorder{Reader: bytes.NewBufferString("body")}
+			bodies = append(bodies, body)
+			return body, nil
+		}
+		req, _ := http.NewRequest("POST", "http://example.com/", nil)
+		req.Body, _ = newBody()
+		req.GetBody = newBody
+
+		_, err := client.Do(req)
+		Expect(err).NotTo(BeNil())
+		Expect(bodies).To(HaveLen(maxRetries + 1))
+		for _, body := range bodies {
+			Eventually(body.isClosed).Should(BeTrue())
+		}
+	})
+
+	It("should not reset a finished response when the request is cancelled", func() {
+		resets := make(chan *RstStream, 1)
+		peers = []func(*Framer){func(peer *Framer) {
+			frame, err := peer.Read()
+			if err != nil {
+				return
+			}
+			peer.Write(&SynReply{
+				Flags:    FlagFin,
+				StreamId: frame.(*SynStream).StreamId,
+				Headers:  NameValuePairs{":status": {"200"}, ":version": {"HTTP/1.1"}},
+			})
+			for {
+				frame, err := peer.Read()
+				if err != nil {
+					return
+				}
+				if rst, ok := frame.(*RstStream); ok {
+					resets <- rst
+				}
+			}
+		}}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, "GET", "http://example.com/", nil)
+		resp, err := client.Do(req)
+		Expect(err).To(BeNil())
+		Expect(ioutil.ReadAll(resp.Body)).To(BeEmpty())
+
+		cancel()
+		Consistently(resets).ShouldNot(Receive())
+		resp.Body.Close()
+		Consistently(resets).ShouldNot(Receive())
+	})
+
+	It("should give up when the request is cancelled", func() {
+		release := make(chan struct{})
+		defer close(release)
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, "GET", "http://example.com/", nil)
+		errs := make(chan error, 1)
+		go func() {
+			_, err := client.Do(req)
+			errs <- err
+		}()
+
+		Consistently(errs).ShouldNot(Receive())
+		cancel()
+		var err error
+		Eventually(errs).Should(Receive(&err))
+		Expect(err).To(MatchError(ContainSubstring("context canceled")))
+	})
+})
+
+// closeRecorder is a request body which notes whether it has been closed.
+type closeRecorder struct {
+	io.Reader
+	mu     sync.Mutex
+	closed bool
+}
+
+func (r *closeRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return nil
+}
+
+func (r *closeRecorder) isClosed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}